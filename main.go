@@ -7,11 +7,12 @@ import (
 	"os/signal"
 	"runtime"
 	"syscall"
+	"io"
 
 	"github.com/dikinova/dktunnel/tunnel"
 	"time"
 	"bytes"
-	"crypto/sha256"
+	"strings"
 	)
 
 const (
@@ -20,27 +21,59 @@ const (
 
 var (
 	startTime = tunnel.TimeNowMs()
+
+	rateFile *string
 )
 
-func handleExitSignal(app tunnel.APP, f *os.File) { //win10下不太有效.
+/// 从-ratefile读取限速配置, 覆盖命令行的配置.
+func loadRateFile() error {
+	if *rateFile == "" {
+		return nil
+	}
+	rl, err := tunnel.LoadRateLimits(*rateFile)
+	if err != nil {
+		return err
+	}
+	tunnel.SetRateLimits(rl)
+	tunnel.Warn("rate limits: %+v", rl)
+	return nil
+}
+
+func handleExitSignal(app tunnel.APP, f io.Closer, rf *tunnel.RotateFile) { //win10下不太有效.
 	// Program that will listen to the SIGINT and SIGTERM
 	// SIGINT will listen to CTRL-C.
 	// SIGTERM will be caught if kill command executed.
-	c := make(chan os.Signal)
+	// reopenSignal(SIGUSR1) will reopen log file, for logrotate.
+	// reloadSignal(SIGUSR2) will reload rate limits from -ratefile.
+	c := make(chan os.Signal, 1)
 	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
+	if reopenSignal != nil {
+		signal.Notify(c, reopenSignal, reloadSignal)
+	}
 
 	for sig := range c {
 		fmt.Fprintf(os.Stderr, "caught sig: %+v \n", sig)
 		switch sig {
+		case reopenSignal:
+			if rf != nil {
+				rf.Reopen() // 失败时已经输出到stderr, 继续写原来的文件
+			}
+		case reloadSignal:
+			if err := loadRateFile(); err != nil {
+				tunnel.Warn("reload rate limits failed: %v", err)
+			}
 		case syscall.SIGHUP:
 			var b bytes.Buffer
 			app.Status(&b)
 			tunnel.Warn("status: %s", b.String())
 			tunnel.Warn("total goroutines:%d", runtime.NumGoroutine())
+			tunnel.Warn("traffic: %s, %s", tunnel.TotalStats.Snapshot(), tunnel.TotalCompress.Snapshot())
 		default:
 			time.Sleep(1 * time.Second)
 			tunnel.Warn("APP END %d", uint16(startTime))
-			f.Close()
+			if f != nil {
+				f.Close()
+			}
 			os.Exit(0)
 		}
 	}
@@ -56,30 +89,182 @@ func main() {
 
 	client := flag.Bool("c", false, "run as client")
 	server := flag.Bool("s", false, "run as server")
-	baddr := flag.String("backend", "1.2.3.4:5555", "backend address.")
-	laddr := flag.String("listen", "127.0.0.1:3333", "listen address.")
-	secret := flag.String("secret", "", "tunnel secret.")
+	baddr := flag.String("backend", "1.2.3.4:5555", "backend address. a client accepts a comma separated server list like host1:port,tcp6://host2:port, optionally weighted as host:port@weight. a server backend may be a unix socket like unix:/var/run/docker.sock.")
+	laddr := flag.String("listen", "127.0.0.1:3333", "listen address. a client may listen on a unix socket like unix:/tmp/dktunnel.sock.")
+	secret := flag.String("secret", "", "tunnel secret. visible to other users in ps, prefer -secretfile or -secretenv.")
+	secretFile := flag.String("secretfile", "", "read secrets from this file (not accessible by other users), one per line, or from stdin if -. the first one is used, a server also accepts the others while rotating secrets. a line like user <name> <secret> names the user of the secret.")
+	secretEnv := flag.String("secretenv", "", "read secrets from this environment variable, one per line like -secretfile.")
 
-	flag.StringVar(&tunnel.CipherName, "cipher", "dummy", "available ciphers: "+tunnel.ListCipher())
+	flag.StringVar(&tunnel.CipherName, "cipher", tunnel.DefaultCiphers, "comma separated ciphers in order of preference, the server picks the first one the client offers. available ciphers: "+tunnel.ListCipher())
+	flag.BoolVar(&tunnel.AllowInsecureCipher, "insecurecipher", false, "allow the insecure ciphers DUMMY and RC4-*.")
+	flag.BoolVar(&tunnel.RequireFeatures, "strict", false, "refuse peers that do not negotiate protocol features (old versions, or a stripped handshake).")
 	flag.BoolVar(&tunnel.ExitOnError, "exiterror", false, "exit on error. just for test.")
 	flag.BoolVar(&tunnel.VerifyCRC, "crc", true, "verify data crc.")
+	flag.StringVar(&tunnel.Compression, "compress", tunnel.CompressNone, "compress tunnel data: none or snappy. used only when both sides enable it.")
+	flag.IntVar(&tunnel.MaxFrameSize, "framesize", tunnel.TunnelPacketSize,
+		fmt.Sprintf("max tunnel frame size, %d..%d. both sides use the smaller one.", tunnel.MinFrameSize, tunnel.MaxFrameLimit))
+
+	flushDelay := flag.Uint("flushdelay", 20, "max milliseconds to hold small writes for coalescing when the tunnel is busy. 0 means flush every write.")
+	lowLatency := flag.Bool("lowlatency", false, "flush every write immediately, for interactive traffic like ssh.")
+
+	resumeTimeout := flag.Uint("resumetimeout", 30, "seconds to keep links after the tunnel broke, waiting for the client to reconnect and resume. 0 disables resumption.")
+	resumeBuffer := flag.Uint("resumebuffer", 8, "max MB of unacknowledged data kept for resumption in every tunnel.")
+	rekeyBytes := flag.Uint("rekeybytes", 1024, "switch to fresh keys after a tunnel sent this many MB. 0 disables.")
+	rekeyInterval := flag.Uint("rekeyinterval", 3600, "switch to fresh keys after this many seconds. 0 disables.")
 
-	tunnels := flag.Uint("tunnels", 1, "(client-only) low level tunnel count.")
+	tunnels := flag.Uint("tunnels", 1, "(client-only) low level tunnel count kept open, at most 3, or 8 with -bond.")
+	maxTunnelsFlag := flag.Uint("maxtunnels", 0, "(client-only) open more tunnels under load, at most this many (up to 16). 0 means the same as -tunnels.")
+	onDemand := flag.Bool("ondemand", false, "(client-only) open no tunnel until the first local connection, and close all of them when idle.")
+	linksPerTunnel := flag.Int("linkspertunnel", 32, "(client-only) open another tunnel when links per tunnel reach this. 0 disables.")
+	inflightPerTunnel := flag.Uint("inflightpertunnel", 4, "(client-only) open another tunnel when unacknowledged MB per tunnel reach this. 0 disables.")
+	selector := flag.String("select", tunnel.DefaultSelector, "(client-only) how a new connection picks its tunnel: "+tunnel.ListSelector()+".")
+	failback := flag.Uint("failback", 30, "(client-only) seconds between attempts to move a tunnel back to its preferred server. 0 disables failback.")
+	redialMin := flag.Uint("redialmin", 1, "(client-only) seconds before the first redial of a failed tunnel, doubled on every failure.")
+	redialMax := flag.Uint("redialmax", 60, "(client-only) max seconds between redials.")
+	authRetry := flag.Uint("authretry", 300, "(client-only) seconds before redialing a server that rejected the secret.")
+	flag.IntVar(&tunnel.PendingMax, "pendingmax", 128, "(client-only) max local connections queued while no tunnel is up.")
+	pendingTimeout := flag.Uint("pendingtimeout", 10, "(client-only) seconds a queued connection waits for a tunnel. 0 closes it at once.")
+	bond := flag.Bool("bond", false, "(client-only) stripe every link across all tunnels to aggregate several uplinks.")
+	transparent := flag.String("transparent", "", "(client-only, linux) transparent proxy mode: redirect (iptables REDIRECT) or tproxy (iptables TPROXY, needs CAP_NET_ADMIN). the server dials the original destination.")
+	bind := flag.String("bind", "", "(client-only) comma separated local ips of the tunnels, used in turn. e.g. the addresses of two uplinks.")
+	rate := flag.String("rate", "0", "global rate limit in bytes/s, K/M/G suffix allowed. 0 means no limit.")
+	tunnelRate := flag.String("tunnelrate", "0", "rate limit of every tunnel in bytes/s.")
+	linkRate := flag.String("linkrate", "0", "rate limit of every link in bytes/s.")
+	flag.StringVar(&tunnel.BackendBalance, "balance", tunnel.BalanceRoundRobin, "(server-only) how a link picks a backend from the list: "+tunnel.ListBalance()+".")
+	flag.BoolVar(&tunnel.AcceptProxy, "acceptproxy", false, "(server-only) read a PROXY protocol v1/v2 header on every tunnel connection from -trustedproxies, and use the client address in it.")
+	trustedProxies := flag.String("trustedproxies", "", "(server-only) comma separated CIDRs of load balancers allowed to send PROXY protocol headers. required by -acceptproxy.")
+	allowDirect := flag.String("allowdirect", "", "(server-only) comma separated CIDRs that transparent proxy clients may reach directly. empty disables transparent proxying.")
+	flag.StringVar(&tunnel.ProxyProtocol, "proxyprotocol", tunnel.ProxyNone, "(server-only) send a PROXY protocol header of this version (none, v1 or v2) to backends without their own ?proxy= option.")
+	flag.IntVar(&tunnel.BackendRetries, "backendretries", 2, "(server-only) other backends to try when a dial fails.")
+	healthCheck := flag.Uint("healthcheck", 5, "(server-only) seconds between tcp health checks of every backend. 0 disables.")
+	flag.IntVar(&tunnel.EjectFailures, "ejectfailures", 3, "(server-only) eject a backend after this many dial failures in a row. 0 disables.")
+	ejectTime := flag.Uint("ejecttime", 30, "(server-only) seconds an ejected backend gets no links.")
+	var quotas tunnel.Quotas
+	flag.IntVar(&quotas.TunnelsPerIP, "maxtunnelsperip", 0, "(server-only) max tunnels from one source ip. 0 means no limit.")
+	flag.IntVar(&quotas.TunnelsPerUser, "maxtunnelsperuser", 0, "(server-only) max tunnels of one user. 0 means no limit.")
+	flag.IntVar(&quotas.LinksPerHub, "maxlinkspertunnel", 0, "(server-only) max concurrent links in one tunnel. 0 means no limit.")
+	flag.IntVar(&quotas.Links, "maxlinks", 0, "(server-only) max concurrent links in total. 0 means no limit.")
+	flag.Int64Var(&quotas.LinkRate, "linkcreaterate", 0, "(server-only) max links created per second. 0 means no limit.")
+	rateFile = flag.String("ratefile", "", "rate limit config file, override rate flags. reloaded on SIGUSR2.")
 	logLevel := flag.Uint("log", 1, "app log level. warn=1, info=2, etc.")
+	flag.StringVar(&tunnel.LogFormat, "logformat", tunnel.LogFormatText, "log format: text or json (one json object per line).")
+	flag.BoolVar(&tunnel.AccessLog, "accesslog", true, "log one access record for every link on close.")
+	logTo := flag.String("logto", "file", "log destination: file (and stderr), stderr or syslog.")
+	logDir := flag.String("logdir", ".", "directory of log file.")
+	logName := flag.String("logname", "gtwarn", "log file name prefix, the file is <logname><date>.log.")
+	logMaxSize := flag.Uint("logmaxsize", 100, "rotate log file when it exceeds this size in MB. 0 means no limit.")
+	logBackups := flag.Uint("logbackups", 10, "max count of old log files to keep. 0 means no limit.")
+	logMaxAge := flag.Uint("logmaxage", 30, "max days to keep old log files. 0 means no limit.")
+	syslogAddr := flag.String("syslog", "", "syslog address like unixgram:/dev/log or udp:127.0.0.1:514. empty means local syslog.")
 
 	flag.Usage = usage
 	flag.Parse()
 
 	tunnel.LogLevel = uint8(*logLevel) //必须在执行parse之后才能访问对应变量
+	if tunnel.LogFormat != tunnel.LogFormatText && tunnel.LogFormat != tunnel.LogFormatJSON {
+		flag.Usage()
+		return
+	}
 
-	if *client == *server || len(*secret) == 0 {
+	if *client == *server {
 		flag.Usage()
 		return
 	}
 
-	_, _, cerr := tunnel.PickCipher(tunnel.CipherName, []byte{1})
-	if cerr != nil {
-		fmt.Fprintf(os.Stderr, "no cipher:%s\n", tunnel.CipherName)
+	sources := 0
+	for _, v := range []string{*secret, *secretFile, *secretEnv} {
+		if v != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		fmt.Fprintf(os.Stderr, "use only one of -secret, -secretfile and -secretenv\n")
+		flag.Usage()
+		return
+	}
+	var secrets []string
+	switch {
+	case *secretFile != "":
+		var serr error
+		if secrets, serr = tunnel.LoadSecrets(*secretFile); serr != nil {
+			fmt.Fprintf(os.Stderr, "load secret failed:%v\n", serr)
+			return
+		}
+	case *secretEnv != "":
+		secrets = tunnel.ParseSecrets(os.Getenv(*secretEnv))
+		os.Unsetenv(*secretEnv) // 不再传给子进程
+	case *secret != "":
+		secrets = []string{*secret}
+	}
+	if len(secrets) == 0 {
+		flag.Usage()
+		return
+	}
+
+	if _, cerr := tunnel.ParseCiphers(tunnel.CipherName); cerr != nil {
+		fmt.Fprintf(os.Stderr, "bad cipher:%v\n", cerr)
+		flag.Usage()
+		return
+	}
+
+	var rl tunnel.RateLimits
+	for _, r := range []struct {
+		s *string
+		v *int64
+	}{{rate, &rl.Global}, {tunnelRate, &rl.Tunnel}, {linkRate, &rl.Link}} {
+		n, rerr := tunnel.ParseRate(*r.s)
+		if rerr != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", rerr)
+			flag.Usage()
+			return
+		}
+		*r.v = n
+	}
+	tunnel.SetRateLimits(rl)
+	tunnel.SetQuotas(quotas)
+
+	if tunnel.Compression != tunnel.CompressNone && tunnel.Compression != tunnel.CompressSnappy {
+		fmt.Fprintf(os.Stderr, "bad compression:%s\n", tunnel.Compression)
+		flag.Usage()
+		return
+	}
+
+	if !strings.Contains(" "+tunnel.ListBalance()+" ", " "+tunnel.BackendBalance+" ") {
+		fmt.Fprintf(os.Stderr, "bad balance:%s\n", tunnel.BackendBalance)
+		flag.Usage()
+		return
+	}
+	if !tunnel.ValidProxy(tunnel.ProxyProtocol) {
+		fmt.Fprintf(os.Stderr, "bad proxy protocol:%s\n", tunnel.ProxyProtocol)
+		flag.Usage()
+		return
+	}
+	var perr error
+	if tunnel.TrustedProxies, perr = tunnel.ParseCIDRs(*trustedProxies); perr != nil {
+		fmt.Fprintf(os.Stderr, "bad trusted proxies:%v\n", perr)
+		flag.Usage()
+		return
+	}
+	if tunnel.AcceptProxy && len(tunnel.TrustedProxies) == 0 {
+		fmt.Fprintf(os.Stderr, "-acceptproxy needs -trustedproxies\n")
+		flag.Usage()
+		return
+	}
+	if tunnel.DirectAllowed, perr = tunnel.ParseCIDRs(*allowDirect); perr != nil {
+		fmt.Fprintf(os.Stderr, "bad allowdirect:%v\n", perr)
+		flag.Usage()
+		return
+	}
+	if !tunnel.ValidTransparent(*transparent) {
+		fmt.Fprintf(os.Stderr, "bad transparent mode:%s\n", *transparent)
+		flag.Usage()
+		return
+	}
+	tunnel.HealthCheckInterval = time.Duration(*healthCheck) * time.Second
+	tunnel.EjectTime = time.Duration(*ejectTime) * time.Second
+
+	if tunnel.MaxFrameSize < tunnel.MinFrameSize || tunnel.MaxFrameSize > tunnel.MaxFrameLimit {
+		fmt.Fprintf(os.Stderr, "bad frame size:%d\n", tunnel.MaxFrameSize)
 		flag.Usage()
 		return
 	}
@@ -90,33 +275,105 @@ func main() {
 
 	//输入参数检验完毕. do some preparing.
 
-	filename := "gtwarn" + time.Now().Format("2006-01-02") + ".log"
-	warnfile, ferr := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	if ferr != nil {
-		tunnel.Error("error opening file: %v", ferr)
+	var warnfile io.Closer
+	var rotatefile *tunnel.RotateFile
+	switch *logTo {
+	case "file":
+		rf, ferr := tunnel.NewRotateFile(*logDir, *logName, int64(*logMaxSize)<<20, int(*logBackups),
+			time.Duration(*logMaxAge)*time.Hour*24)
+		if ferr != nil {
+			tunnel.Error("error opening file: %v", ferr)
+			return
+		}
+		defer rf.Close()
+		warnfile, rotatefile = rf, rf
+		tunnel.InitLogger(rf, uint16(startTime))
+	case "stderr":
+		tunnel.InitLogger(nil, uint16(startTime))
+	case "syslog":
+		var network, raddr string
+		if *syslogAddr != "" {
+			i := strings.Index(*syslogAddr, ":")
+			if i < 0 {
+				fmt.Fprintf(os.Stderr, "bad syslog address:%s\n", *syslogAddr)
+				flag.Usage()
+				return
+			}
+			network, raddr = (*syslogAddr)[:i], (*syslogAddr)[i+1:]
+		}
+		if serr := tunnel.InitSyslogLogger(network, raddr, uint16(startTime)); serr != nil {
+			fmt.Fprintf(os.Stderr, "connect syslog failed:%v\n", serr)
+			return
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "bad log destination:%s\n", *logTo)
+		flag.Usage()
 		return
 	}
-	defer warnfile.Close()
-	tunnel.InitLogger(warnfile, uint16(startTime))
 
 	tunnel.Warn("APP START %d", uint16(startTime))
-	kd := sha256.Sum256([]byte(*secret))
-	tunnel.Warn("protocal: %s, cipher: %s, secret-hash-hex: %x \n", Version, tunnel.CipherName, kd[:3])
+	tunnel.FlushDelay = time.Duration(*flushDelay) * time.Millisecond
+	tunnel.ResumeTimeout = time.Duration(*resumeTimeout) * time.Second
+	tunnel.FailbackInterval = time.Duration(*failback) * time.Second
+	tunnel.PendingTimeout = time.Duration(*pendingTimeout) * time.Second
+	tunnel.RedialMin = time.Duration(*redialMin) * time.Second
+	tunnel.RedialMax = time.Duration(*redialMax) * time.Second
+	tunnel.RedialAuthFailed = time.Duration(*authRetry) * time.Second
+	tunnel.ResumeBuffer = int(*resumeBuffer) << 20
+	tunnel.RekeyBytes = int64(*rekeyBytes) << 20
+	tunnel.RekeyInterval = time.Duration(*rekeyInterval) * time.Second
+
+	if rerr := loadRateFile(); rerr != nil {
+		fmt.Fprintf(os.Stderr, "load rate file failed:%v\n", rerr)
+		return
+	}
+	tunnel.Warn("protocal: %s, cipher: %s, secrets: %d \n", Version, tunnel.CipherName, len(secrets))
+	if *secret != "" {
+		tunnel.Warn("the secret on the command line is visible to other users, prefer -secretfile or -secretenv")
+	}
 
 	// start app now
 	var app tunnel.APP
 	var err error
 
 	if *server {
-		app, err = tunnel.NewServer(*laddr, *baddr, *secret)
+		var s *tunnel.Server
+		if s, err = tunnel.NewServer(*laddr, *baddr, secrets[0]); err == nil {
+			s.LowLatency = *lowLatency
+			s.ExtraSecrets = secrets[1:]
+			app = s
+		}
 	}
 
 	if *client {
 		tunnel.Debug("APP client mode")
-		if *tunnels < 1 || *tunnels > 3 {
+		maxTunnels := uint(3)
+		if *bond {
+			maxTunnels = 8
+		}
+		if *tunnels < 1 || *tunnels > maxTunnels {
 			*tunnels = 1
 		}
-		app, err = tunnel.NewClient(*laddr, *baddr, *secret, *tunnels)
+		if *maxTunnelsFlag < *tunnels || *maxTunnelsFlag > 16 || *bond {
+			*maxTunnelsFlag = *tunnels
+		}
+		var c *tunnel.Client
+		if c, err = tunnel.NewClient(*laddr, *baddr, secrets[0], *tunnels); err == nil {
+			c.MaxTunnels = *maxTunnelsFlag
+			if *onDemand && !*bond {
+				c.MinTunnels = 0
+			}
+			c.LinksPerTunnel = *linksPerTunnel
+			c.InFlightPerTunnel = int64(*inflightPerTunnel) << 20
+			c.LowLatency = *lowLatency
+			c.Bond = *bond
+			c.Transparent = *transparent
+			c.Selector, err = tunnel.NewSelector(*selector)
+			if *bind != "" {
+				c.BindAddrs = strings.Split(*bind, ",")
+			}
+			app = c
+		}
 	}
 
 	if err != nil {
@@ -128,7 +385,7 @@ func main() {
 	go tunnel.Report(app)
 
 	// waiting for signal
-	go handleExitSignal(app, warnfile)
+	go handleExitSignal(app, warnfile, rotatefile)
 
 	tunnel.Warn("APP END %d %v", uint16(startTime), app.Start())
 }
@@ -0,0 +1,14 @@
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+/// 收到该信号时重新打开日志文件, 配合logrotate.
+var reopenSignal os.Signal = syscall.SIGUSR1
+
+/// 收到该信号时重新读取限速配置.
+var reloadSignal os.Signal = syscall.SIGUSR2
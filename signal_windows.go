@@ -0,0 +1,9 @@
+package main
+
+import (
+	"os"
+)
+
+/// windows没有SIGUSR1, SIGUSR2.
+var reopenSignal os.Signal = nil
+var reloadSignal os.Signal = nil
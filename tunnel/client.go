@@ -7,6 +7,8 @@ import (
 	"time"
 	mrand "math/rand"
 	"io"
+	"fmt"
+	"sync/atomic"
 )
 
 const (
@@ -23,14 +25,17 @@ type ClientHub struct {
 	*Hub
 	hPriority int // current link count
 	hIndex    int // index in the heap
+	index     int   // 第几个tunnel, 重新连接时使用相同的本地地址
+	endpoint  *Endpoint // 连接的server
+	pingMs    int64 // 最近一次心跳的发送时间
+	rttMs     int64 // 平滑之后的心跳RTT
 }
 
 func newClientHub(tunnel *Tunnel) *ClientHub {
 	h := &ClientHub{
-		Hub: newHub(tunnel),
+		Hub: newHub(tunnel, RoleClient),
 	}
 	h.Hub.onCtrlFilter = h.onCtrl
-	go h.heartbeat()
 	return h
 }
 
@@ -40,16 +45,20 @@ func (h *ClientHub) heartbeat() {
 	tspan := time.Duration(1000*HeartBeartSpan + mrand.Intn(1000))
 	ticker := time.NewTicker(time.Millisecond * tspan)
 	defer ticker.Stop()
-	for range ticker.C {
-		if !h.SendCmd(0, CD_HEARTBEAT) {
-			break
-		}
+	for ok := h.ping(); ok; ok = h.ping() { // 立即发送第一个心跳, 尽快测得RTT
+		<-ticker.C
 	}
 }
 
-func (h *ClientHub) onCtrl(cmd Ctrl) bool {
+func (h *ClientHub) ping() bool {
+	atomic.StoreInt64(&h.pingMs, TimeNowMs())
+	return h.SendCmd(0, CD_HEARTBEAT)
+}
+
+func (h *ClientHub) onCtrl(cmd Ctrl, extra []byte) bool {
 	switch cmd.Code {
 	case CD_HEARTBEAT:
+		h.onPong()
 		return true
 	}
 	return false
@@ -57,6 +66,7 @@ func (h *ClientHub) onCtrl(cmd Ctrl) bool {
 
 func (h *ClientHub) Status(w io.Writer) {
 	h.Hub.Status(w)
+	fmt.Fprintf(w, ", endpoint %s, rtt %v", h.endpoint, h.RTT())
 	Info("priority:%d, index:%d", h.hPriority, h.hIndex)
 }
 
@@ -94,26 +104,64 @@ func (cq *clientHubQueue) Pop() interface{} {
 
 /// tunnel client
 type Client struct {
-	laddr   string
-	backend string
-	secret  string
-	tunnels uint
-
-	hq   clientHubQueue
-	lock sync.Mutex
+	laddr      string
+	listenAddr net.Addr
+	endpoints  []Endpoint
+	secret     string
+	tunnels    uint
+
+	LowLatency  bool        // 每次写入都立即flush, 适合交互式的应用
+	Selector    HubSelector // 新连接选择hub的策略, nil表示link最少
+	Bond        bool        // 多路捆绑, 每个link同时使用所有tunnel
+	BindAddrs   []string    // tunnel的本地IP, 按tunnel序号轮流使用. 用于多条线路
+	Transparent string      // 透明代理模式: redirect, tproxy, 空表示不使用. 见z_transparent.go
+
+	MinTunnels        uint  // 始终保持的tunnel数, 0表示按需连接. 见z_pool.go
+	MaxTunnels        uint  // 负载高时最多的tunnel数
+	LinksPerTunnel    int   // 平均每个tunnel的link数超过它时增加tunnel, 0表示不按link数增加
+	InFlightPerTunnel int64 // 平均每个tunnel的在途字节超过它时增加tunnel, 0表示不按在途字节增加
+
+	bond *bondGroup
+
+	slots   []poolSlot
+	hq      clientHubQueue
+	pending []*pendingConn // 等待hub的连接
+	lock    sync.Mutex
+
+	listener net.Listener
+	quit     chan struct{}  // Stop时关闭
+	wg       sync.WaitGroup // Stop等待的goroutine: Start, 每个tunnel位置, 负载检查, 会话恢复
 }
 
-func (cli *Client) createHub() (hub *ClientHub, err error) {
-	conn, err := dial(cli.backend)
+/// 建立连接并完成握手. ticket不为0时请求恢复这个会话.
+func (cli *Client) handshake(index int, ep *Endpoint, ticket Ticket) (tunnel *Tunnel, features Features, err error) {
+	var bind string
+	if len(cli.BindAddrs) > 0 {
+		bind = cli.BindAddrs[index%len(cli.BindAddrs)]
+	}
+	conn, err := dial(ep.Network, bind, ep.Addr)
 	if err != nil {
 		return
 	}
 	Debug("client dial OK")
 
-	tunnel := newTunnel(conn)
+	tunnel = newTunnel(conn)
+	defer func() {
+		if err != nil {
+			tunnel.Close()
+		}
+	}()
+	local := localFeatures()
+	local.Ticket = ticket
+	local.Direct = cli.Transparent != ""
+	if cli.bond != nil {
+		local.Bond = cli.bond.id
+	}
 	helloA := newHelloA(cli.secret)
+	offered := local.toBytes()
+	helloData := append(helloA.toBytes(), offered...)
 
-	if err = tunnel.WritePacket(0, helloA.toBytes(), true); err != nil {
+	if err = tunnel.WritePacket(0, helloData, FlushNow); err != nil {
 		Error("write token failed(%v):%s", tunnel, err)
 		return
 	}
@@ -124,31 +172,104 @@ func (cli *Client) createHub() (hub *ClientHub, err error) {
 		return
 	}
 
+	// challenge之后附加的是server选择的扩展. 老版本的server没有附加数据.
+	// 两端的扩展都计入challenge和回复的MAC, 被篡改时认证失败.
 	taa := NewTaa(cli.secret)
+	hasFeatures := false
+	if len(helloB) > TaaBlockSize {
+		if features, hasFeatures = parseFeatures(helloB[TaaBlockSize:]); hasFeatures {
+			taa.BindFeatures(offered, helloB[TaaBlockSize:])
+		}
+		helloB = helloB[:TaaBlockSize]
+	}
+
 	helloC, err := taa.ExchangeCipherBlock(helloB)
 	if err != nil {
 		Error("exchange challenge failed(%v) %v", tunnel, err)
+		err = ErrAuthFailed // server的secret不同
 		return
 	}
 
-	if err = tunnel.WritePacket(0, helloC, true); err != nil {
+	if !hasFeatures {
+		if err = legacyPeer(LogFields{FieldRole: RoleClient, FieldRemote: ep.Addr}); err != nil {
+			return
+		}
+	}
+	if err = checkChosenCipher(features); err != nil {
+		Error("cipher mismatch(%v): server chose %v from %s", tunnel, features.Ciphers, CipherName)
+		return
+	}
+
+	if err = tunnel.WritePacket(0, helloC, FlushNow); err != nil {
 		Error("write token failed(%v):%s", tunnel, err)
 		return
 	}
 
-	tunnel.tconn.setKeys(taa.Token, cli.secret, true)
+	tunnel.tconn.setKeys(taa.Token, cli.secret, features.cipher(), true)
+	tunnel.setFeatures(features)
+	tunnel.tunId = taa.Token.ToID()
+	return
+}
+
+func (cli *Client) createHub(index int, ep *Endpoint) (hub *ClientHub, err error) {
+	tunnel, features, err := cli.handshake(index, ep, Ticket{})
+	if err != nil {
+		return
+	}
 
 	hub = newClientHub(tunnel)
-	hub.tunnel.tunId = taa.Token.ToID()
+	hub.index = index
+	hub.endpoint = ep
+	hub.lowLatency = cli.LowLatency
+	hub.linkAddrs = features.Addr
+	hub.direct = features.Direct
+	if features.Resume && !features.Ticket.IsZero() {
+		hub.sess = newSession(features.Ticket)
+		hub.onDetach = func() { cli.resumeHub(hub) }
+	}
+	if cli.bond != nil && features.Bond == cli.bond.id {
+		cli.bond.join(hub.Hub)
+	}
+	go hub.heartbeat() // 第一个心跳立即发送, 要在设置好会话之后开始
 
-	Warn("client: %v, handshake succeed", hub.tunnel)
+	WarnEvent("handshake", hub.fields(0))
 	return
 }
 
+/// tunnel断开之后重新连接, 恢复hub的会话. server已经丢弃会话时结束会话, hub随之关闭.
+func (cli *Client) resumeHub(hub *ClientHub) {
+	if !cli.track() {
+		return
+	}
+	defer cli.wg.Done()
+	defer Recover()
+	sess := hub.sess
+	var bo backoff // 和重新连接tunnel一样的间隔, 多个tunnel不会同时重试
+	for !sess.isExpired() {
+		tunnel, features, err := cli.handshake(hub.index, hub.endpoint, sess.ticket)
+		switch {
+		case err != nil:
+			WarnEvent("session_reconnect_failed", hub.fields(0).With(LogFields{FieldReason: err}))
+			bo.wait(err, cli.quit)
+		case !features.Resume || features.Ticket != sess.ticket:
+			WarnEvent("session_lost", hub.fields(0).With(LogFields{"ticket": sess.ticket}))
+			tunnel.Close()
+			sess.expire()
+			return
+		case hub.attach(tunnel):
+			return
+		default:
+			tunnel.Close()
+			return
+		}
+	}
+}
+
 func (cli *Client) addHub(item *ClientHub) {
 	cli.lock.Lock()
 	defer cli.lock.Unlock()
 	heap.Push(&cli.hq, item)
+	cli.flushPendingLocked()
 }
 
 func (cli *Client) removeHub(item *ClientHub) {
@@ -157,16 +278,17 @@ func (cli *Client) removeHub(item *ClientHub) {
 	heap.Remove(&cli.hq, item.hIndex)
 }
 
-func (cli *Client) fetchHub() *ClientHub {
-	cli.lock.Lock()
-	defer cli.lock.Unlock()
-
+/// 选择hub并增加它的link计数, 没有hub时返回nil. 调用者持有lock.
+func (cli *Client) fetchHubLocked(src net.Addr) *ClientHub {
 	if len(cli.hq) == 0 {
 		return nil
 	}
 	item := cli.hq[0]
+	if cli.Selector != nil {
+		item = cli.Selector.Select(cli.hq, src)
+	}
 	item.hPriority += 1
-	heap.Fix(&cli.hq, 0)
+	heap.Fix(&cli.hq, item.hIndex)
 	return item
 }
 
@@ -177,102 +299,277 @@ func (cli *Client) downHub(chub *ClientHub) {
 	heap.Fix(&cli.hq, chub.hIndex)
 }
 
-func (cli *Client) handleLinkConn(chub *ClientHub, kconn *net.TCPConn) {
+func (cli *Client) handleLinkConn(chub *ClientHub, kconn halfConn) {
 	defer Recover()
 	defer cli.downHub(chub)
 	CT(T_Coroutine, OP_Increase)
 	defer CT(T_Coroutine, OP_Decrease)
 
-	id := LinkNextId()
-
 	h := chub.Hub
-	k := h.createLink(id)
+	k := h.allocLink()
+	if k == nil {
+		Error("%s no free link id", h.tunnel)
+		kconn.Close()
+		return
+	}
+	id := k.id
 	defer h.deleteLink(id)
+	k.srcAddr, _ = kconn.RemoteAddr().(*net.TCPAddr)
+	k.dstAddr, _ = kconn.LocalAddr().(*net.TCPAddr)
+	if cli.Transparent != "" {
+		dst, err := cli.directDst(h, kconn)
+		if err != nil {
+			WarnEvent("conn_dropped", chub.fields(id).With(LogFields{FieldRemote: addrString(kconn.RemoteAddr()),
+				FieldReason: err}))
+			kconn.Close()
+			return
+		}
+		k.dstAddr, k.direct = dst, true
+	}
 
-	h.SendCmd(id, CD_LINK_CREATE)
+	h.createRemote(k)
 	h.runLink(k, kconn)
 }
 
 func (cli *Client) listen() error {
-	listener, err := net.Listen("tcp", cli.laddr)
+	var listener net.Listener
+	var err error
+	if cli.Transparent == TransparentTProxy {
+		listener, err = listenTProxy(cli.laddr)
+	} else {
+		listener, err = listenLocal(cli.laddr)
+	}
 	if err != nil {
 		return err
 	}
-
 	defer listener.Close()
+	cli.lock.Lock()
+	cli.listenAddr = listener.Addr()
+	cli.listener = listener
+	stopped := cli.stoppedLocked()
+	cli.lock.Unlock()
+	if stopped {
+		return ErrStopped
+	}
 
-	tcpListener := listener.(*net.TCPListener)
 	for {
-		kconn, err := tcpListener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 				Warn("acceept failed temporary: %s", netErr.Error())
 				continue
+			} else if cli.stopped() {
+				return ErrStopped
 			} else {
 				return err
 			}
 		}
-		Info("new connection from %v", kconn.RemoteAddr())
-		chub := cli.fetchHub()
-		if chub == nil {
-			Error("no active hub")
-			kconn.Close()
-			continue
-		}
-
-		// 这是link对应的连接的时间设置
-		// 这不是TCP标准的一部分,并且不同的平台有不同的实现
-		// 而且设置的时间生效比较慢.
-		kconn.SetKeepAlive(true)
-		kconn.SetKeepAlivePeriod(time.Second * 30)
-		go cli.handleLinkConn(chub, kconn)
+		kconn := conn.(halfConn)
+		Info("new connection from %v", addrString(kconn.RemoteAddr()))
+		cli.dispatchConn(kconn)
 	}
 }
 
 func (cli *Client) Start() error {
-	sz := cap(cli.hq)
-	for i := 0; i < sz; i++ {
-		go func(index int) {
-			defer Recover()
-			CT(T_Coroutine, OP_Increase)
-			defer CT(T_Coroutine, OP_Decrease)
-
-			for {
-				hub, err := cli.createHub()
-				if err != nil {
-					Warn("client: %d tunnel, connect failed", index)
-					time.Sleep(time.Second * (10))
-					continue
-				}
-
-				cli.addHub(hub)
-				hub.Start()
-				cli.removeHub(hub)
-				Warn("client: %d tunnel %5d, disconnected", index, hub.tunnel.tunId)
-			}
-		}(i)
+	if _, err := ParseCiphers(CipherName); err != nil {
+		return err
+	}
+	if cli.Transparent != "" {
+		if !ValidTransparent(cli.Transparent) {
+			return fmt.Errorf("bad transparent mode %s", cli.Transparent)
+		}
+		if !transparentSupported {
+			return ErrTransparentNotSupported
+		}
+		if _, ok := unixPath(cli.laddr); ok {
+			return fmt.Errorf("transparent proxy needs a tcp listener")
+		}
+	}
+	if cli.Bond {
+		if len(cli.endpoints) > 1 { // 组内的tunnel必须连接同一个server
+			return fmt.Errorf("bonding needs a single server, got %d", len(cli.endpoints))
+		}
+		if cli.MinTunnels != cli.MaxTunnels { // 组内的tunnel离开时会重置所有link
+			return fmt.Errorf("bonding needs a fixed tunnel count")
+		}
+		cli.bond = newBondGroup(newBondId())
+	}
+	if cli.MaxTunnels < cli.MinTunnels || cli.MaxTunnels == 0 {
+		return fmt.Errorf("bad tunnel count %d..%d", cli.MinTunnels, cli.MaxTunnels)
+	}
+	cli.lock.Lock()
+	if cli.stoppedLocked() {
+		cli.lock.Unlock()
+		return ErrStopped
 	}
+	cli.wg.Add(1)
+	defer cli.wg.Done()
+	cli.slots = make([]poolSlot, cli.MaxTunnels)
+	for i := 0; i < int(cli.MinTunnels); i++ {
+		cli.startSlotLocked(i)
+	}
+	if cli.MaxTunnels > cli.MinTunnels {
+		cli.wg.Add(1)
+		go func() {
+			defer cli.wg.Done()
+			cli.autoscale()
+		}()
+	}
+	cli.lock.Unlock()
 
-	time.Sleep(time.Second * 2) // 暂停一下.等待hub都创建完毕.
 	return cli.listen()
 }
 
+/// 停止监听, 关闭排队的连接, 主动关闭所有tunnel(会话不再恢复), 等Start和各个tunnel的goroutine结束之后返回.
+func (cli *Client) Stop() {
+	cli.lock.Lock()
+	if cli.stoppedLocked() {
+		cli.lock.Unlock()
+		return
+	}
+	close(cli.quit)
+	if cli.listener != nil {
+		cli.listener.Close()
+	}
+	for i := range cli.slots {
+		if s := &cli.slots[i]; s.running && !s.quitting() {
+			close(s.quit)
+		}
+	}
+	for _, p := range cli.pending {
+		p.timer.Stop()
+		p.conn.Close()
+	}
+	cli.pending = nil
+	hubs := append([]*ClientHub(nil), cli.hq...)
+	cli.lock.Unlock()
+
+	for _, hub := range hubs {
+		hub.shutdown()
+	}
+	cli.wg.Wait()
+}
+
+func (cli *Client) stopped() bool {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	return cli.stoppedLocked()
+}
+
+func (cli *Client) stoppedLocked() bool {
+	select {
+	case <-cli.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+/// 登记一个Stop要等待的goroutine, 已经Stop时返回false.
+func (cli *Client) track() bool {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	if cli.stoppedLocked() {
+		return false
+	}
+	cli.wg.Add(1)
+	return true
+}
+
+/// 维持第index个tunnel: 断开之后重新连接, 有更优先的server可用时切换过去. quit关闭时等hub的link结束之后返回.
+func (cli *Client) runTunnel(index int, quit <-chan struct{}) {
+	defer Recover()
+	CT(T_Coroutine, OP_Increase)
+	defer CT(T_Coroutine, OP_Decrease)
+
+	var bo backoff
+	var next *ClientHub
+	for {
+		select {
+		case <-quit:
+			if next != nil {
+				next.shutdown()
+				next.closeAllLink()
+			}
+			return
+		default:
+		}
+		hub := next
+		next = nil
+		if hub == nil {
+			var err error
+			if hub, err = cli.connect(index); err != nil {
+				Warn("client: %d tunnel, connect failed, %v", index, err)
+				bo.wait(err, quit)
+				continue
+			}
+		}
+		started := time.Now()
+
+		cli.addHub(hub)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			hub.Start()
+		}()
+		stop := make(chan struct{})
+		select {
+		case <-done:
+			close(stop)
+			cli.removeHub(hub)
+			Warn("client: %d tunnel %5d, disconnected", index, hub.tunnel.tunId)
+			if time.Since(started) < hubStableTime {
+				bo.wait(nil, quit)
+			} else {
+				bo.reset()
+			}
+		case next = <-cli.failback(index, hub, stop):
+			close(stop)
+			cli.removeHub(hub)
+			go cli.drain(hub, done)
+		case <-quit:
+			close(stop)
+			cli.removeHub(hub)
+			cli.drain(hub, done)
+			<-done
+			Info("client: %d tunnel %5d, closed by pool", index, hub.tunnel.tunId)
+			return
+		}
+	}
+}
+
 func (cli *Client) Status(w io.Writer) {
 	cli.lock.Lock()
 	defer cli.lock.Unlock()
+	fmt.Fprintf(w, "\n<client> endpoints %v, pending %d", cli.endpoints, len(cli.pending))
+	cli.poolStatus(w)
 	for _, hub := range cli.hq {
 		hub.Status(w)
 	}
 }
 
+/// backend是逗号分隔的server列表, 见ParseEndpoints
 func NewClient(listen, backend, secret string, tunnels uint) (*Client, error) {
+	endpoints, err := ParseEndpoints(backend)
+	if err != nil {
+		return nil, err
+	}
+	for _, ep := range endpoints {
+		if ep.Network == "unix" {
+			return nil, fmt.Errorf("server %s: tunnels need tcp", ep)
+		}
+	}
+	_, secret = SplitSecret(secret) // client和server可以使用同一个secret文件
 	client := &Client{
-		laddr:   listen,
-		backend: backend,
-		secret:  secret,
-		tunnels: tunnels,
-
-		hq: make(clientHubQueue, tunnels)[0:0],
+		laddr:      listen,
+		endpoints:  endpoints,
+		secret:     secret,
+		tunnels:    tunnels,
+		MinTunnels: tunnels,
+		MaxTunnels: tunnels,
+
+		hq:   make(clientHubQueue, tunnels)[0:0],
+		quit: make(chan struct{}),
 	}
 	return client, nil
 }
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"sync"
-	"net"
 	"time"
 	"io"
 	"fmt"
@@ -17,12 +16,41 @@ const (
 	CD_LINK_CLOSE_WriteErr
 	CD_LINK_CLOSE_ReadErr
 	CD_HEARTBEAT
+	CD_LINK_CLOSE_Rejected // server拒绝新建link, 超出准入限制
+	CD_ACK                 // 会话: 确认收到的packet数, CtrlSeq
+	CD_RESUME              // 会话: 恢复之后告知收到的packet数, CtrlSeq
+	CD_SESSION_END         // 会话: 主动关闭, 对端不必再等待恢复, CtrlSeq
+	CD_REKEY               // 换密钥, CtrlRekey. 由Tunnel处理, 不交给hub
+)
+
+var ctrlNames = []string{"CD_LINK_DATA", "CD_LINK_CREATE", "CD_LINK_CLOSE",
+	"CD_LINK_CLOSE_WriteErr", "CD_LINK_CLOSE_ReadErr", "CD_HEARTBEAT", "CD_LINK_CLOSE_Rejected",
+	"CD_ACK", "CD_RESUME", "CD_SESSION_END", "CD_REKEY"}
+
+func ctrlName(code uint8) string {
+	if int(code) < len(ctrlNames) {
+		return ctrlNames[code]
+	}
+	return fmt.Sprintf("CD_%d", code)
+}
+
+const (
+	RoleClient = "client"
+	RoleServer = "server"
+
+	DefaultUser = "default" // 只有一个secret时的用户名
 )
 
 type Ctrl struct {
 	// 为了进行自动序列化操作, 字段一定要导出,大写开头.
 	Code   uint8  // control command
-	LinkId uint16 // id
+	LinkId uint32 // id
+}
+
+/// 老版本协议(没有协商HeaderExt)的Ctrl, LinkId是16位.
+type Ctrl16 struct {
+	Code   uint8
+	LinkId uint16
 }
 
 type Hub struct {
@@ -30,41 +58,84 @@ type Hub struct {
 	tunnel *Tunnel
 
 	rwmx   sync.RWMutex // protect links
-	links  map[uint16]*Link
+	links  map[uint32]*Link
+	nextId uint32 // 上一次分配的link id, 每个hub独立分配
 	Closed bool
 
-	onCtrlFilter func(cmd Ctrl) bool
+	role       string       // client / server, 用于日志
+	user       string       // 认证用户, 用于日志和按用户限速. 用setUser修改
+	limiter    *RateLimiter // tunnel限速
+	uLimiter   *RateLimiter // 用户限速, 同一个用户的hub共用
+	lowLatency bool         // 每次写入都立即flush
+	linkAddrs  bool         // CD_LINK_CREATE附带本地连接的地址
+	direct     bool         // server允许透明代理的link直接连接目的地址
+	rejected   bool         // 对端认识CD_LINK_CLOSE_Rejected
+
+	sess     *session   // 协商了会话恢复时不为nil
+	onDetach func()     // tunnel断开, 开始等待恢复. client在这里重新连接
+	bond     *bondGroup // 协商了多路捆绑时不为nil, link属于组而不是hub
+
+	onCtrlFilter func(cmd Ctrl, extra []byte) bool // extra是Ctrl之后附加的数据, 只在调用期间有效
 }
 
-func newHub(tunnel *Tunnel) *Hub {
+func newHub(tunnel *Tunnel, role string) *Hub {
 	CT(T_Hub, OP_Increase)
 	return &Hub{
-		tunnel: tunnel,
-		links:  make(map[uint16]*Link),
+		tunnel:   tunnel,
+		links:    make(map[uint32]*Link),
+		role:     role,
+		user:     DefaultUser,
+		limiter:  newRateLimiter(&tunnelRate),
+		uLimiter: userLimiter(DefaultUser),
 	}
 }
 
-func (h *Hub) SendCmd(linkId uint16, code uint8) bool {
-	buf := bytes.NewBuffer(mpool.Get()[0:0])
-	c := Ctrl{
-		Code:   code,
-		LinkId: linkId,
+/// 设置认证用户和对应的限速器
+func (h *Hub) setUser(user string) {
+	h.user = user
+	h.uLimiter = userLimiter(user)
+}
+
+/// 结构化日志的公共字段. linkId为0表示tunnel自身的事件.
+func (h *Hub) fields(linkId uint32) LogFields {
+	f := LogFields{
+		FieldRole:   h.role,
+		FieldTun:    h.tunnel.tunId,
+		FieldRemote: h.tunnel.remoteAddr(),
 	}
-	binary.Write(buf, TByteOrder, &c)
-	Debug("tun(%5d) link(%d) send cmd:%d data:%v", h.tunnel.tunId, linkId, code, c)
-	return h.Send(0, buf.Bytes(), false)
+	if linkId != 0 {
+		f[FieldLink] = linkId
+	}
+	if h.user != "" {
+		f[FieldUser] = h.user
+	}
+	return f
 }
 
-func (h *Hub) Send(id uint16, data []byte, forceFlush bool) bool {
-	if err := h.tunnel.WritePacket(id, data, forceFlush); err != nil {
-		Warn("link(%d) write to %s failed:%s", id, h.tunnel, err.Error())
+func (h *Hub) SendCmd(linkId uint32, code uint8) bool {
+	buf := bytes.NewBuffer(mpool.Get(0))
+	if h.tunnel.ext {
+		binary.Write(buf, TByteOrder, &Ctrl{code, linkId})
+	} else {
+		binary.Write(buf, TByteOrder, &Ctrl16{code, uint16(linkId)})
+	}
+	DebugEvent("send_cmd", h.fields(linkId).With(LogFields{"code": code}))
+	return h.Send(0, buf.Bytes(), FlushIdle)
+}
+
+func (h *Hub) Send(id uint32, data []byte, flush FlushMode) bool {
+	if h.sess != nil {
+		return h.sendSession(id, data, flush)
+	}
+	if err := h.tunnel.WritePacket(id, data, flush); err != nil {
+		WarnEvent("tunnel_write_failed", h.fields(id).With(LogFields{FieldReason: err}))
 		return false
 	}
 	return true
 }
 
-func (h *Hub) onCtrl(cmd Ctrl) {
-	if h.onCtrlFilter != nil && h.onCtrlFilter(cmd) {
+func (h *Hub) onCtrl(cmd Ctrl, extra []byte) {
+	if h.onCtrlFilter != nil && h.onCtrlFilter(cmd, extra) {
 		return
 	}
 
@@ -72,28 +143,45 @@ func (h *Hub) onCtrl(cmd Ctrl) {
 	k := h.getLink(id)
 	if k == nil {
 		// 有可能远程数据发送过来,但是本地的link已经提前异常退出了.
-		Info("link(%d) recv cmd:%d, no link", id, cmd.Code)
+		InfoEvent("link_missing", h.fields(id).With(LogFields{"code": cmd.Code}))
 		return
 	}
 
-	switch cmd.Code {
+	h.onLinkCmd(k, cmd.Code)
+}
+
+/// 对端发来的link命令
+func (h *Hub) onLinkCmd(k *Link, code uint8) {
+	switch code {
+	case CD_LINK_CLOSE, CD_LINK_CLOSE_WriteErr, CD_LINK_CLOSE_ReadErr, CD_LINK_CLOSE_Rejected:
+		k.setCloseReason(CloseSideRemote, ctrlName(code))
+	}
+
+	switch code {
 	case CD_LINK_CLOSE:
 		k.closeAll()
 	case CD_LINK_CLOSE_WriteErr:
 		k.closeRead()
 	case CD_LINK_CLOSE_ReadErr:
-		k.closeWrite()
+		k.finishWrite() // 之前收到的数据可能还在wchannel中, 写完再关闭
+	case CD_LINK_CLOSE_Rejected:
+		k.abort()
 	default:
-		Error("link(%d) receive unknown cmd:%v", id, cmd)
+		WarnEvent("unknown_cmd", h.fields(k.id).With(LogFields{"code": ctrlName(code)}))
 	}
 }
 
-func (h *Hub) onData(id uint16, data []byte) {
+func (h *Hub) onData(id uint32, data []byte) {
+	h.shapeIn(len(data))
+	if h.bond != nil {
+		h.bond.onData(h, id, data)
+		return
+	}
 	link := h.getLink(id)
 
 	if link == nil {
 		mpool.Put(data)
-		Info("link(%d) no link", id)
+		InfoEvent("link_missing", h.fields(id).With(LogFields{FieldBytes: len(data)}))
 		return
 	}
 
@@ -106,35 +194,70 @@ func (h *Hub) Start() {
 	defer h.Close()
 	CT(T_Coroutine, OP_Increase)
 	defer CT(T_Coroutine, OP_Decrease)
-	Warn("%s start", h.tunnel)
+	WarnEvent("tunnel_start", h.fields(0))
+	if h.sess != nil {
+		go h.ackLoop()
+		defer close(h.sess.ackCh) // 只有本goroutine发送通知
+	}
+	for h.dispatch() && h.sess != nil && h.waitResume() {
+	}
+
+	// tunnel disconnect, so reset all link
+	WarnEvent("tunnel_reset", h.fields(0))
+	if h.sess != nil {
+		h.sess.expire()
+	}
+	h.closeAllLink()
+}
+
+/// 读取并分发packet, 直到tunnel断开. 返回true表示可以等待会话恢复.
+func (h *Hub) dispatch() bool {
 	for {
 		linkId, data, err := h.tunnel.ReadPacket()
 		if err != nil {
-			Warn("%s read failed:%v", h.tunnel, err)
-			break
+			WarnEvent("tunnel_read_failed", h.fields(0).With(LogFields{FieldReason: err}))
+			return true
 		}
 
-		if linkId == 0 {
-			var cmd Ctrl
-			buf := bytes.NewBuffer(data)
-			err := binary.Read(buf, TByteOrder, &cmd)
+		if h.sess != nil && h.onSessionPacket(linkId, data) {
 			mpool.Put(data)
+			continue
+		}
+
+		if linkId == 0 {
+			cmd, err := h.parseCtrl(data)
 			//cmd.fromBytes(data)
 			if err != nil {
-				Error("tun(%5d) parse failed:%s, break dispatch", h.tunnel.tunId, err.Error())
-				break
+				mpool.Put(data)
+				WarnEvent("ctrl_parse_failed", h.fields(0).With(LogFields{FieldReason: err}))
+				return false
 			}
-			Debug("tun(%5d) link(%d) recv cmd:%d", h.tunnel.tunId, linkId, cmd.Code)
-			h.onCtrl(cmd)
+			DebugEvent("recv_cmd", h.fields(cmd.LinkId).With(LogFields{"code": cmd.Code}))
+			h.onCtrl(cmd, data[h.ctrlSize():])
+			mpool.Put(data)
 		} else {
-			Debug("tun(%5d) link(%d) recv %d bytes data", h.tunnel.tunId, linkId, len(data))
+			DebugEvent("recv_data", h.fields(linkId).With(LogFields{FieldBytes: len(data)}))
 			h.onData(linkId, data)
 		}
 	}
+}
 
-	// tunnel disconnect, so reset all link
-	Warn("%s reset all link", h.tunnel)
-	h.closeAllLink()
+func (h *Hub) ctrlSize() int {
+	if h.tunnel.ext {
+		return binary.Size(Ctrl{})
+	}
+	return binary.Size(Ctrl16{})
+}
+
+func (h *Hub) parseCtrl(data []byte) (cmd Ctrl, err error) {
+	buf := bytes.NewBuffer(data)
+	if h.tunnel.ext {
+		err = binary.Read(buf, TByteOrder, &cmd)
+		return
+	}
+	var c16 Ctrl16
+	err = binary.Read(buf, TByteOrder, &c16)
+	return Ctrl{c16.Code, uint32(c16.LinkId)}, err
 }
 
 func (h *Hub) Close() {
@@ -150,67 +273,168 @@ func (h *Hub) Close() {
 func (h *Hub) Status(w io.Writer) {
 	h.rwmx.RLock()
 	defer h.rwmx.RUnlock()
-	var links []uint16
-	for id := range h.links {
-		links = append(links, id)
+	fmt.Fprintf(w, "\n<status> %s, links(%d), %s", h.tunnel, len(h.links), h.tunnel.Stats())
+	if h.bond != nil {
+		fmt.Fprintf(w, ", %s", h.bond)
+	}
+	if h.tunnel.compress != 0 {
+		fmt.Fprintf(w, ", %s", h.tunnel.CompressStats())
+	}
+	if n := h.tunnel.Rekeys(); n > 0 {
+		fmt.Fprintf(w, ", rekeys %d", n)
+	}
+	if h.sess != nil {
+		fmt.Fprintf(w, ", %s", h.sess)
+	}
+	for id, k := range h.links {
+		fmt.Fprintf(w, "\n    link(%d) %s", id, k.stats.Snapshot())
 	}
-	fmt.Fprintf(w, "\n<status> %s, links(%d)", h.tunnel, len(h.links))
 }
 
 /// client,server共用此函数
 func (h *Hub) closeAllLink() {
+	if h.bond != nil {
+		h.bond.leave(h)
+	}
 	h.rwmx.Lock()
 	defer h.rwmx.Unlock()
 
 	for _, k := range h.links {
+		k.setCloseReason(CloseSideTunnel, "hub_reset")
 		k.closeAll()
 	}
 
-	h.links = make(map[uint16]*Link) // clear links
+	h.links = make(map[uint32]*Link) // clear links
 
 }
 
 /// hub function
-func (h *Hub) getLink(id uint16) *Link {
+func (h *Hub) getLink(id uint32) *Link {
+	if h.bond != nil {
+		return h.bond.getLink(id)
+	}
 	h.rwmx.RLock()
 	defer h.rwmx.RUnlock()
 	return h.links[id]
 }
 
 /// 共用
-func (h *Hub) deleteLink(id uint16) {
-	Info("link(%d) delete", id)
+func (h *Hub) deleteLink(id uint32) {
+	InfoEvent("link_delete", h.fields(id))
+	if h.bond != nil {
+		h.bond.deleteLink(id)
+		return
+	}
 	h.rwmx.Lock()
 	defer h.rwmx.Unlock()
 	delete(h.links, id)
 }
 
-///共用
-func (h *Hub) createLink(id uint16) *Link {
-	Info("link(%d) new link", id)
+/// server端使用, id由client分配. 捆绑的link见bondGroup.claimLink
+func (h *Hub) createLink(id uint32) *Link {
+	InfoEvent("link_new", h.fields(id))
 	h.rwmx.Lock()
 	defer h.rwmx.Unlock()
 	if _, ok := h.links[id]; ok {
-		Error("link(%d) repeated", id)
+		WarnEvent("link_repeated", h.fields(id))
 		return nil
 	}
-	l := &Link{
-		id:       id,
-		wchannel: make(ByteChan, 30),
+	return h.newLinkLocked(id)
+}
+
+/// client端使用. 分配一个未使用的id并创建link, 跳过仍在使用的id.
+/// 所有id都在使用时返回nil.
+func (h *Hub) allocLink() *Link {
+	if h.bond != nil {
+		return h.bond.allocLink(h)
+	}
+	h.rwmx.Lock()
+	defer h.rwmx.Unlock()
+	max := h.tunnel.maxLinkId()
+	if uint64(len(h.links)) >= uint64(max) {
+		return nil
+	}
+	for {
+		h.nextId++
+		if h.nextId == 0 || h.nextId > max {
+			h.nextId = 1
+		}
+		if _, ok := h.links[h.nextId]; !ok {
+			break
+		}
 	}
-	CT(T_Link, OP_Increase)
-	CT(T_Channel, OP_Increase)
+	InfoEvent("link_new", h.fields(h.nextId))
+	return h.newLinkLocked(h.nextId)
+}
+
+func (h *Hub) newLinkLocked(id uint32) *Link {
+	l := newLink(id, h.tunnel.maxFrame)
 	h.links[id] = l
 	return l
 }
 
+/// link当前的数量
+func (h *Hub) linkCount() int {
+	if h.bond != nil {
+		return h.bond.linkCount()
+	}
+	h.rwmx.RLock()
+	defer h.rwmx.RUnlock()
+	return len(h.links)
+}
+
+/// 通知对端新建link
+func (h *Hub) createRemote(k *Link) {
+	if h.bond != nil {
+		h.bond.createRemote(k)
+		return
+	}
+	h.sendCreate(k)
+}
+
+/// 发送CD_LINK_CREATE. 协商了featAddr时附带本地连接的地址.
+func (h *Hub) sendCreate(k *Link) bool {
+	if !h.linkAddrs || k.srcAddr == nil {
+		return h.SendCmd(k.id, CD_LINK_CREATE)
+	}
+	buf := bytes.NewBuffer(mpool.Get(0))
+	if h.tunnel.ext {
+		binary.Write(buf, TByteOrder, &Ctrl{CD_LINK_CREATE, k.id})
+	} else {
+		binary.Write(buf, TByteOrder, &Ctrl16{CD_LINK_CREATE, uint16(k.id)})
+	}
+	addrs := encodeLinkAddrs(k.srcAddr, k.dstAddr)
+	if k.direct && len(addrs) > 0 {
+		addrs[0] |= linkAddrDirect
+	}
+	buf.Write(addrs)
+	DebugEvent("send_cmd", h.fields(k.id).With(LogFields{"code": CD_LINK_CREATE, "src": k.srcAddr}))
+	return h.Send(0, buf.Bytes(), FlushIdle)
+}
+
+/// runLink发送kconn读到的数据. 捆绑的link加上序号, 分散到组内的tunnel.
+func (h *Hub) sendLinkData(k *Link, data []byte, flush FlushMode) bool {
+	if h.bond != nil {
+		return h.bond.send(k, CD_LINK_DATA, data, flush)
+	}
+	return h.Send(k.id, data, flush)
+}
+
+/// runLink发送关闭命令. 捆绑的link的命令和数据一起排序, 不会先于数据到达.
+func (h *Hub) sendLinkCmd(k *Link, code uint8) bool {
+	if h.bond != nil {
+		return h.bond.send(k, code, nil, FlushIdle)
+	}
+	return h.SendCmd(k.id, code)
+}
+
 /// client,server端公用该函数
-func (h *Hub) runLink(k *Link, conn *net.TCPConn) {
-	conn.SetKeepAlive(true)
-	conn.SetKeepAlivePeriod(time.Second * 30)
+func (h *Hub) runLink(k *Link, conn halfConn) {
+	setKeepAlive(conn, time.Second*30)
 	k.setConn(conn)
 
-	Info("link(%d) start: %v", k.id, conn.RemoteAddr())
+	lf := h.fields(k.id).With(LogFields{FieldRemote: addrString(conn.RemoteAddr())})
+	InfoEvent("link_start", lf)
 	defer k.closeAll()
 
 	var wg sync.WaitGroup
@@ -222,20 +446,23 @@ func (h *Hub) runLink(k *Link, conn *net.TCPConn) {
 
 	LOOP:
 		for {
+			h.waitRoom()
 			data, err := k.readKConn()
 			switch {
 			case err == errClosed:
-				h.SendCmd(k.id, CD_LINK_CLOSE)
+				h.sendLinkCmd(k, CD_LINK_CLOSE)
 				break LOOP
 
 			case err == errReadClosed:
-				h.SendCmd(k.id, CD_LINK_CLOSE_ReadErr)
+				h.sendLinkCmd(k, CD_LINK_CLOSE_ReadErr)
 				break LOOP
 			case err != nil:
 				Fail()
 			case err == nil:
-				ok := h.Send(k.id, data, false)
+				h.shape(k, len(data))
+				ok := h.sendLinkData(k, data, h.flushMode(k, len(data)))
 				if !ok {
+					k.setCloseReason(CloseSideTunnel, "tunnel_write_failed")
 					break LOOP
 				}
 
@@ -257,15 +484,79 @@ func (h *Hub) runLink(k *Link, conn *net.TCPConn) {
 				break
 			}
 
-			_, err := k.kconn.Write(data)
+			k.inLimiter.Wait(len(data)) // 见shapeIn
+			n, err := k.kconn.Write(data)
+			k.stats.addOut(n)
 			mpool.Put(data)
 			if err != nil {
+				k.setCloseReason(CloseSideLocal, "write_err")
 				// need drain wchannel
-				h.SendCmd(k.id, CD_LINK_CLOSE_WriteErr)
+				h.sendLinkCmd(k, CD_LINK_CLOSE_WriteErr)
 				break
 			}
 		}
 	}()
 	wg.Wait()
-	Info("link(%d) close", k.id)
+	k.closeKConn()
+	InfoEvent("link_close", lf.With(LogFields{FieldDuration: TimeNowMs() - k.startMs}))
+
+	if h.role == RoleClient {
+		h.accessLog(k, linkAddrString(k.srcAddr, conn.RemoteAddr()), linkAddrString(k.dstAddr, conn.LocalAddr()))
+	} else {
+		h.accessLog(k, linkAddrString(k.srcAddr, nil), addrString(conn.RemoteAddr()))
+	}
+}
+
+/// 从kconn读到的数据何时flush. 没有读满说明暂时没有后续数据, 尽快发出; 读满时还有数据, 可以合并.
+func (h *Hub) flushMode(k *Link, n int) FlushMode {
+	switch {
+	case h.lowLatency:
+		return FlushNow
+	case n < k.frame:
+		return FlushIdle
+	}
+	return FlushLazy
+}
+
+/// 限速: link, tunnel, 用户, 全局. tunnel, 用户和全局两个方向共用令牌, link每个方向一个令牌桶.
+/// 发送方向在runLink读取kconn之后等待.
+func (h *Hub) shape(k *Link, n int) {
+	k.limiter.Wait(n)
+	h.limiter.Wait(n)
+	h.uLimiter.Wait(n)
+	globalLimiter.Wait(n)
+}
+
+/// 接收方向在hub的读goroutine中等待tunnel, 用户和全局的令牌, 这些限制本来就作用于整个tunnel.
+/// link的令牌在写goroutine写入kconn之前等待, 只有本端设置了linkrate也生效. wchannel(捆绑时是乱序窗口)
+/// 写满之后对端的发送随之变慢.
+func (h *Hub) shapeIn(n int) {
+	h.limiter.Wait(n)
+	h.uLimiter.Wait(n)
+	globalLimiter.Wait(n)
+}
+
+/// 输出link的访问日志. client, backend是link两端的地址, tunnel对端记在remote字段.
+func (h *Hub) accessLog(k *Link, client, backend string) {
+	k.lock.Lock()
+	side, reason := k.closeSide, k.closeReason
+	k.lock.Unlock()
+
+	st := k.stats.Snapshot()
+	up, down := st.BytesIn, st.BytesOut
+
+	if h.role == RoleServer { // server从backend读入的是下行数据
+		up, down = down, up
+	}
+
+	AccessEvent(h.fields(k.id).With(LogFields{
+		FieldClient:    client,
+		FieldBackend:   backend,
+		FieldStart:     time.Unix(0, k.startMs*Milli).Format(time.RFC3339Nano),
+		FieldDuration:  TimeNowMs() - k.startMs,
+		FieldBytesUp:   up,
+		FieldBytesDown: down,
+		FieldSide:      side,
+		FieldReason:    reason,
+	}))
 }
@@ -0,0 +1,61 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+/// 协商了f的client hub, 返回tunnel的对端连接.
+func pipeHub(t *testing.T, f Features) (*Hub, net.Conn) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	tun := newTunnel(c1)
+	tun.setFeatures(f)
+	return newHub(tun, RoleClient), c2
+}
+
+/// 没有协商HeaderExt时id是16位, 回绕之后跳过仍在使用的id. 每个hub独立分配.
+func TestAllocLinkWraparound(t *testing.T) {
+	h, _ := pipeHub(t, Features{})
+	h.links[1] = newLink(1, h.tunnel.maxFrame)
+	h.nextId = 0xFFFE
+	for _, want := range []uint32{0xFFFF, 2, 3} {
+		if k := h.allocLink(); k == nil || k.id != want {
+			t.Fatalf("alloc %v, want %d", k, want)
+		}
+	}
+
+	other, _ := pipeHub(t, Features{})
+	if k := other.allocLink(); k == nil || k.id != 1 {
+		t.Fatalf("other hub alloc %v, want 1", k)
+	}
+}
+
+/// 双方都支持HeaderExt时使用32位id, Ctrl中的id不会截断.
+func TestLinkId32(t *testing.T) {
+	f := localFeatures().intersect(localFeatures())
+	if !f.ExtHeader {
+		t.Fatal("ExtHeader not negotiated")
+	}
+	if old := localFeatures().intersect(Features{}); old.ExtHeader {
+		t.Fatal("ExtHeader negotiated with an old peer")
+	}
+
+	h, peer := pipeHub(t, f)
+	h.nextId = 0xFFFF
+	k := h.allocLink()
+	if k == nil || k.id != 0x10000 {
+		t.Fatalf("alloc %v, want 0x10000", k)
+	}
+
+	r := newHub(newTunnel(peer), RoleServer)
+	r.tunnel.setFeatures(f)
+	go h.SendCmd(k.id, CD_LINK_CREATE)
+	_, data, err := r.tunnel.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd, err := r.parseCtrl(data); err != nil || cmd.LinkId != k.id || cmd.Code != CD_LINK_CREATE {
+		t.Fatalf("ctrl %+v %v", cmd, err)
+	}
+}
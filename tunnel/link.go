@@ -7,22 +7,70 @@ import (
 	"time"
 )
 
+/// link关闭的发起方.
+const (
+	CloseSideLocal  = "local"  // 本地连接kconn
+	CloseSideRemote = "remote" // 对端发来的关闭命令
+	CloseSideTunnel = "tunnel" // tunnel断开或者写失败
+)
+
 type ByteChan chan []byte
 
 type Link struct {
-	id          uint16
-	kconn       *net.TCPConn
+	stats       TrafficStats // in: 从kconn读入, out: 写入kconn
+	id          uint32
+	kconn       halfConn
 	wchannel    ByteChan // write buffer
 	writeClosed bool
+	finishing   bool // 对端不再发送, wchannel已经关闭, 写完剩余数据之后关闭写方向
 	readClosed  bool
+	startMs     int64
+
+	closeSide   string // 第一次关闭的发起方
+	closeReason string // 第一次关闭的原因
+	aborted     bool   // 用RST关闭kconn
+	frame       int    // 一次最多读取的字节数, 即tunnel的最大帧
+	limiter     *RateLimiter // 发送方向: 从kconn读入
+	inLimiter   *RateLimiter // 接收方向: 写入kconn
+	srcAddr     *net.TCPAddr // 本地连接的来源和目的地址, 用于PROXY protocol
+	dstAddr     *net.TCPAddr
+	direct      bool // 透明代理: server直接连接dstAddr
 	closeOnce   sync.Once
 	lock        sync.Mutex // protects below fields
+
+	// 多路捆绑
+	paths   []*bondMember     // 可以使用的tunnel
+	outSeq  uint32            // 下一个发出的序号
+	bondMux sync.Mutex        // protects below fields
+	inSeq      uint32            // 下一个要交付的序号
+	reorder    map[uint32][]byte // 乱序到达的packet
+	ready      [][]byte          // 按顺序等待交付的packet
+	buffered   int               // reorder中的字节数
+	pending    int               // ready中, 以及正在交付的字节数
+	delivering bool              // deliverReady正在运行
+	drained    *sync.Cond        // 交付了一批packet, pending减少
+	bondReset  bool              // 超出乱序窗口, 丢弃之后的packet
+}
+
+func newLink(id uint32, frame int) *Link {
+	CT(T_Link, OP_Increase)
+	CT(T_Channel, OP_Increase)
+	k := &Link{
+		id:       id,
+		wchannel: make(ByteChan, 30),
+		frame:    frame,
+		startMs:  TimeNowMs(),
+		limiter:   newRateLimiter(&linkRate),
+		inLimiter: newRateLimiter(&linkRate),
+	}
+	k.drained = sync.NewCond(&k.bondMux)
+	return k
 }
 
 func (k *Link) writeChannel(data []byte) error {
 	k.lock.Lock()
 	defer k.lock.Unlock()
-	if k.writeClosed {
+	if k.writeClosed || k.finishing {
 		mpool.Put(data)
 		return errWriteClosed
 	}
@@ -30,6 +78,15 @@ func (k *Link) writeChannel(data []byte) error {
 	return nil
 }
 
+/// 记录关闭原因, 只保留第一次.
+func (k *Link) setCloseReason(side, reason string) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.closeReason == "" {
+		k.closeSide, k.closeReason = side, reason
+	}
+}
+
 /// stop read data from link
 func (k *Link) closeRead() {
 	k.lock.Lock()
@@ -57,7 +114,9 @@ func (k *Link) closeWrite() {
 		k.kconn.CloseWrite()
 	}
 
-	close(k.wchannel)
+	if !k.finishing {
+		close(k.wchannel)
+	}
 	drain := func() {
 		for data := range k.wchannel {
 			mpool.Put(data)
@@ -69,12 +128,35 @@ func (k *Link) closeWrite() {
 
 }
 
+/// 对端的读方向结束. 和closeWrite不同, 已经收到的数据仍然写入kconn, 写完之后再关闭写方向.
+func (k *Link) finishWrite() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.writeClosed || k.finishing {
+		return
+	}
+	k.finishing = true
+	close(k.wchannel) // 写goroutine写完剩余的数据之后调用closeWrite
+}
+
 func (k *Link) tryToCloseKConn() {
 	if (k.readClosed && k.writeClosed && k.kconn != nil) {
 		k.kconn.Close()
 	}
 }
 
+/// 对端拒绝了link. 用RST关闭本地连接, 让应用看到connection reset而不是正常结束.
+func (k *Link) abort() {
+	k.lock.Lock()
+	k.aborted = true
+	if k.kconn != nil { // 先关闭, 避免closeWrite发送FIN
+		setResetOnClose(k.kconn)
+		k.kconn.Close()
+	}
+	k.lock.Unlock()
+	k.closeAll()
+}
+
 /// close link
 func (k *Link) closeAll() {
 	k.closeOnce.Do(func() {
@@ -95,43 +177,52 @@ func (k *Link) readKConn() ([]byte, error) {
 		return nil, errReadClosed
 	}
 
-	b := mpool.Get()
+	b := mpool.Get(k.frame)
 	deadLine := time.Now().Add(time.Second * time.Duration(60*5))
 	k.kconn.SetReadDeadline(deadLine)
 	n, err := k.kconn.Read(b)
 
 	switch {
 	case err == io.EOF:
+		k.setCloseReason(CloseSideLocal, "EOF")
 		k.closeRead()
 		mpool.Put(b)
 		return nil, errReadClosed
 	case err != nil:
+		reason := "read_err"
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			reason = "read_deadline"
+		}
+		k.setCloseReason(CloseSideLocal, reason)
 		k.closeAll()
 		mpool.Put(b)
 		return nil, errClosed
 	}
 
+	k.stats.addIn(n)
+	if n <= k.frame/4 { // 换成小规格的buffer, 数据在channel和tunnel中排队时不浪费内存
+		small := mpool.Get(n)
+		copy(small, b[:n])
+		mpool.Put(b)
+		return small, nil
+	}
 	return b[:n], nil
 }
 
 /// set low level connection
-func (k *Link) setConn(conn *net.TCPConn) {
+func (k *Link) setConn(conn halfConn) {
 	if k.kconn != nil {
 		Panic("link(%d) repeated set conn", k.id)
 	}
 	k.kconn = conn
 }
 
-var (
-	linkIdCounter = uint16(0)
-)
-
-func LinkNextId() uint16 {
-	IdGenMux.Lock()
-	defer IdGenMux.Unlock()
-	linkIdCounter += 1
-	if linkIdCounter == 0 {
-		linkIdCounter = 1
+/// 读写都结束后关闭kconn. link可能在设置conn之前已经被关闭, 这时kconn还没有关闭.
+func (k *Link) closeKConn() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if k.aborted {
+		setResetOnClose(k.kconn)
 	}
-	return linkIdCounter
+	k.kconn.Close()
 }
@@ -1,7 +1,10 @@
 package tunnel
 
 import (
+	"encoding/binary"
+	"errors"
 	"net"
+	"strings"
 	"time"
 	"sync"
 	"io"
@@ -10,13 +13,14 @@ import (
 /// server hub
 type ServerHub struct {
 	*Hub
-	backendAddr *net.TCPAddr
+	backend *backendPool
+	ip      string // 当前连接占用的IP名额, 会话恢复时换成新连接的IP. 持有Server.mux时访问
 }
 
-func newServerHub(tunnel *Tunnel, baddr *net.TCPAddr) *ServerHub {
+func newServerHub(tunnel *Tunnel, backend *backendPool) *ServerHub {
 	sh := &ServerHub{
-		Hub:         newHub(tunnel),
-		backendAddr: baddr,
+		Hub:     newHub(tunnel, RoleServer),
+		backend: backend,
 	}
 	sh.Hub.onCtrlFilter = sh.onCtrl
 	return sh
@@ -25,27 +29,66 @@ func newServerHub(tunnel *Tunnel, baddr *net.TCPAddr) *ServerHub {
 func (h *ServerHub) handleServerLink(k *Link) {
 	defer Recover()
 	defer h.deleteLink(k.id)
+	defer releaseLink()
 	CT(T_Coroutine, OP_Increase)
 	defer CT(T_Coroutine, OP_Decrease)
 
-	conn, err := net.DialTCP("tcp", nil, h.backendAddr)
+	if k.direct {
+		h.handleDirectLink(k)
+		return
+	}
+
+	conn, m, err := h.backend.dial(hostOf(h.tunnel.remoteAddr()))
 	if err != nil {
-		Error("link(%d) connect to backend failed, err:%v", k.id, err)
+		WarnEvent("link_dial_failed", h.fields(k.id).With(LogFields{FieldBackend: h.backend.String(), FieldReason: err}))
+		k.setCloseReason(CloseSideLocal, "dial_failed")
+		h.SendCmd(k.id, CD_LINK_CLOSE)
+		h.accessLog(k, linkAddrString(k.srcAddr, nil), h.backend.String())
+		return
+	}
+	defer h.backend.release(m)
+
+	if err := writeProxyHeader(conn, m.proxy, k.srcAddr, k.dstAddr); err != nil {
+		WarnEvent("proxy_header_failed", h.fields(k.id).With(LogFields{FieldBackend: m.ep.Addr, FieldReason: err}))
+		conn.Close()
+		k.setCloseReason(CloseSideLocal, "proxy_failed")
 		h.SendCmd(k.id, CD_LINK_CLOSE)
+		h.accessLog(k, linkAddrString(k.srcAddr, nil), m.ep.Addr)
 		return
 	}
 
 	h.runLink(k, conn)
 }
 
-func (h *ServerHub) onCtrl(cmd Ctrl) bool {
+func (h *ServerHub) onCtrl(cmd Ctrl, extra []byte) bool {
 	id := cmd.LinkId
 	switch cmd.Code {
 	case CD_LINK_CREATE:
-		l := h.createLink(id)
+		var l *Link
+		var err error
+		if h.bond != nil { // 捆绑的link在每个tunnel上都有CREATE, 只处理第一个
+			var claimed bool
+			if l, claimed, err = h.bond.claimLink(h.Hub, id); !claimed {
+				return true
+			}
+		} else if err = h.admitLink(); err == nil {
+			l = h.createLink(id)
+		}
+		if err != nil {
+			WarnEvent("link_rejected", h.fields(id).With(LogFields{FieldReason: err}))
+			if h.rejected {
+				h.SendCmd(id, CD_LINK_CLOSE_Rejected)
+			} else { // 老版本的client不认识CD_LINK_CLOSE_Rejected
+				h.SendCmd(id, CD_LINK_CLOSE)
+			}
+			return true
+		}
 		if l != nil {
+			l.srcAddr, l.dstAddr, l.direct = parseLinkAddrs(extra)
+			l.direct = l.direct && h.direct // 没有协商透明代理时按普通link连接backend
 			go h.handleServerLink(l)
 		} else {
+			releaseLink()
 			h.SendCmd(id, CD_LINK_CLOSE)
 		}
 		return true
@@ -56,38 +99,97 @@ func (h *ServerHub) onCtrl(cmd Ctrl) bool {
 	return false
 }
 
+var ErrStopped = errors.New("stopped")
+
 /// tunnel server
 type Server struct {
 	listener net.Listener
-	baddr    *net.TCPAddr
+	backend  *backendPool
 	secret   string
 	hubs     map[*ServerHub]bool
+	sessions map[Ticket]*ServerHub // 可以恢复的会话
+	bonds    map[bondKey]*bondGroup // 多路捆绑的组
 	mux      sync.Mutex
+	counter  *tunnelCounter
+	quit     chan struct{}  // Stop时关闭
+	wg       sync.WaitGroup // Stop等待的goroutine: Start, 健康检查, 每个连接
+
+	LowLatency   bool     // 每次写入都立即flush, 适合交互式的应用
+	ExtraSecrets []string // 轮换期间同时接受的其他secret. 见z_secret.go
 }
 
-func (s *Server) handleConn(conn net.Conn) {
-	defer conn.Close()
+/// ipErr是占用IP名额的结果. 超出名额的连接只能恢复同一个IP的会话, 沿用断开的连接的名额.
+func (s *Server) handleConn(conn net.Conn, ip string, ipErr error) {
+	ownIP := ipErr == nil // IP名额交给hub之后由hub释放
+	defer func() {
+		if ownIP {
+			s.counter.releaseIP(ip)
+		}
+	}()
+	adopted := false // 连接被恢复的会话接管, 不能关闭
+	defer func() {
+		if !adopted {
+			conn.Close()
+		}
+	}()
 	defer Recover()
 	CT(T_Coroutine, OP_Increase)
 	defer CT(T_Coroutine, OP_Decrease)
 
 	tunnel := newTunnel(conn)
 
-	_, _, err := tunnel.ReadPacket()
+	_, helloA, err := tunnel.ReadPacket()
 	if err != nil {
 		Error("read helloA failed(%v):%s", tunnel, err)
 		return
 	}
 
+	// helloA之后附加的是client支持的扩展. 老版本的client没有附加数据, 回复的challenge也不附加.
+	var features Features
+	var hasFeatures bool
+	var resumed *ServerHub
+	var clientCiphers []string
+	var clientFeatures Features
+	if n := binary.Size(HelloA{}); len(helloA) > n {
+		if clientFeatures, hasFeatures = parseFeatures(helloA[n:]); hasFeatures {
+			features = localFeatures().intersect(clientFeatures)
+			clientCiphers = clientFeatures.Ciphers
+		}
+		// client要求恢复时总是回复原来的ticket, 否则分配新的会话. 认证之前不能透露会话是否还在,
+		// 认证通过之后才接替原来的tunnel, 会话已经不在时用CD_SESSION_END通知client.
+		if features.Resume {
+			if features.Ticket = clientFeatures.Ticket; features.Ticket.IsZero() {
+				features.Ticket = newTicket()
+			} else {
+				resumed = s.findSession(features.Ticket)
+			}
+		}
+	}
+
+	if !hasFeatures && legacyPeer(LogFields{FieldRole: RoleServer, FieldRemote: conn.RemoteAddr().String()}) != nil {
+		return
+	}
+
 	// authenticate connection
-	taa := NewTaa(s.secret)
+	user, secret := s.matchSecret(helloA)
+	taa := NewTaa(secret)
 	taa.GenRandomToken() //服务器生成随机token 每个hub的token都不一样
 
-	hello := taa.GenCipherBlock(nil)
-	if err := tunnel.WritePacket(0, hello, true); err != nil {
+	var chosen []byte
+	if hasFeatures {
+		chosen = features.toBytes()
+		taa.BindFeatures(helloA[binary.Size(HelloA{}):], chosen)
+	}
+	hello := append(taa.GenCipherBlock(nil), chosen...)
+	if err := tunnel.WritePacket(0, hello, FlushNow); err != nil {
 		Error("write challenge failed(%v):%s", tunnel, err)
 		return
 	}
+	if features.hasCiphers && len(features.Ciphers) == 0 {
+		WarnEvent("tunnel_rejected", LogFields{FieldRole: RoleServer, FieldRemote: conn.RemoteAddr().String(),
+			FieldReason: ErrCipherMismatch, "offered": strings.Join(clientCiphers, ","), "allowed": CipherName})
+		return
+	}
 
 	_, token, err := tunnel.ReadPacket()
 	if err != nil {
@@ -100,21 +202,133 @@ func (s *Server) handleConn(conn net.Conn) {
 		return
 	}
 
-	tunnel.tconn.setKeys(taa.Token, s.secret, false)
-	sh := newServerHub(tunnel, s.baddr)
-	sh.tunnel.tunId = taa.Token.ToID()
+	if resumed != nil && resumed.user != user { // ticket不能转给其他用户
+		Error("resume session of user %s by %s(%v)", resumed.user, user, tunnel)
+		resumed = nil
+	}
+	if ipErr != nil && (resumed == nil || !s.hasIP(resumed, ip)) {
+		WarnEvent("tunnel_rejected", LogFields{FieldRole: RoleServer, FieldRemote: conn.RemoteAddr().String(),
+			FieldReason: ipErr})
+		return
+	}
+
+	tunnel.tconn.setKeys(taa.Token, secret, features.cipher(), false)
+	tunnel.setFeatures(features)
+	tunnel.tunId = taa.Token.ToID()
+	if resumed != nil {
+		if adopted = resumed.attach(tunnel); adopted && ownIP {
+			ownIP = !s.handOverIP(resumed, ip)
+		}
+		return
+	}
+	if features.Resume && !clientFeatures.Ticket.IsZero() { // client要恢复的会话已经不在
+		WarnEvent("session_lost", LogFields{FieldRole: RoleServer, FieldRemote: conn.RemoteAddr().String(),
+			FieldUser: user, "ticket": features.Ticket})
+		sendSessionLost(tunnel)
+		return
+	}
+
+	if err := s.counter.acquireUser(user); err != nil {
+		WarnEvent("tunnel_rejected", LogFields{FieldRole: RoleServer, FieldRemote: conn.RemoteAddr().String(),
+			FieldUser: user, FieldReason: err})
+		return
+	}
+	defer s.counter.releaseUser(user)
+
+	sh := newServerHub(tunnel, s.backend)
+	sh.setUser(user)
+	sh.rejected = features.Rejected
+	sh.direct = features.Direct
+	sh.ip, ownIP = ip, false
+	sh.lowLatency = s.LowLatency
+	if features.Resume {
+		sh.sess = newSession(features.Ticket)
+	}
 	s.mux.Lock()
+	if s.stoppedLocked() { // Stop已经关闭了所有hub
+		s.mux.Unlock()
+		return
+	}
 	s.hubs[sh] = true // map is not thread safe
+	if sh.sess != nil {
+		s.sessions[features.Ticket] = sh
+	}
+	if !features.Bond.IsZero() { // 组属于认证的用户, 其他用户使用同样的id得到的是另一个组
+		key := bondKey{user, features.Bond}
+		g := s.bonds[key]
+		if g == nil {
+			g = newBondGroup(features.Bond)
+			g.user = user
+			s.bonds[key] = g
+		}
+		g.join(sh.Hub)
+	}
 	s.mux.Unlock()
-	Warn("server: %v, handshake succeed", sh.tunnel)
+	WarnEvent("handshake", sh.fields(0))
 
-	defer delete(s.hubs, sh)
+	defer func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		s.counter.releaseIP(sh.ip)
+		sh.ip = ""
+		delete(s.hubs, sh)
+		if sh.sess != nil {
+			delete(s.sessions, sh.sess.ticket)
+		}
+		if sh.bond != nil && sh.bond.empty() {
+			delete(s.bonds, bondKey{sh.bond.user, sh.bond.id})
+		}
+	}()
 
 	sh.Start()
 }
 
+/// 恢复的会话接管了新的连接, 新连接的IP名额交给hub, 释放断开的连接的名额.
+/// hub已经结束时返回false, 由调用者释放.
+func (s *Server) handOverIP(sh *ServerHub, ip string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if sh.ip == "" {
+		return false
+	}
+	s.counter.releaseIP(sh.ip)
+	sh.ip = ip
+	return true
+}
+
+func (s *Server) hasIP(sh *ServerHub, ip string) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return sh.ip == ip
+}
+
+func (s *Server) findSession(t Ticket) *ServerHub {
+	if t.IsZero() {
+		return nil
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.sessions[t]
+}
+
 func (s *Server) Start() error {
 	defer s.listener.Close()
+	if !s.track() {
+		return ErrStopped
+	}
+	defer s.wg.Done()
+	if _, err := ParseCiphers(CipherName); err != nil {
+		return err
+	}
+	if AcceptProxy && len(TrustedProxies) == 0 {
+		return ErrNoTrustedProxies
+	}
+	if s.track() {
+		go func() {
+			defer s.wg.Done()
+			s.backend.healthCheck(s.quit)
+		}()
+	}
 	for {
 		tcpL := s.listener.(*net.TCPListener)
 		conn, err := tcpL.AcceptTCP()
@@ -122,42 +336,117 @@ func (s *Server) Start() error {
 			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
 				Warn("server: acceept failed temporary: %s", netErr.Error())
 				continue
+			} else if s.stopped() {
+				return ErrStopped
 			} else {
 				return err
 			}
 		}
-		Warn("server: new connection from %v", conn.RemoteAddr())
+		if !s.track() {
+			conn.Close()
+			return ErrStopped
+		}
 		conn.SetKeepAlive(true)
 		conn.SetKeepAlivePeriod(time.Second * 60)
-		go s.handleConn(conn)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+/// 停止接受新的tunnel, 主动关闭所有hub(会话不再恢复), 等Start和处理连接的goroutine结束之后返回.
+func (s *Server) Stop() {
+	s.mux.Lock()
+	if s.stoppedLocked() {
+		s.mux.Unlock()
+		return
+	}
+	close(s.quit)
+	hubs := make([]*ServerHub, 0, len(s.hubs))
+	for hub := range s.hubs {
+		hubs = append(hubs, hub)
+	}
+	s.mux.Unlock()
+
+	s.listener.Close()
+	for _, hub := range hubs {
+		hub.shutdown()
+	}
+	s.wg.Wait()
+}
+
+func (s *Server) stopped() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.stoppedLocked()
+}
+
+func (s *Server) stoppedLocked() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+/// 登记一个Stop要等待的goroutine, 已经Stop时返回false.
+func (s *Server) track() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.stoppedLocked() {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+/// 按需读取PROXY protocol的头, 用真实的client地址做准入检查, 然后握手.
+func (s *Server) serveConn(tcpConn *net.TCPConn) {
+	conn, err := acceptProxy(tcpConn)
+	if err != nil {
+		WarnEvent("tunnel_rejected", LogFields{FieldRole: RoleServer, FieldRemote: tcpConn.RemoteAddr().String(),
+			FieldReason: err})
+		tcpConn.Close()
+		return
 	}
+	Warn("server: new connection from %v", conn.RemoteAddr())
+	ip := addrIP(conn.RemoteAddr())
+	s.handleConn(conn, ip, s.counter.acquireIP(ip))
 }
 
 func (s *Server) Status(w io.Writer) {
 	s.mux.Lock()
 	defer s.mux.Unlock()
+	s.backend.Status(w)
 	for hub := range s.hubs {
 		hub.Status(w)
 	}
 }
 
-/// create a tunnel server
+/// create a tunnel server. backend是逗号分隔的地址列表, 见z_backend.go
 func NewServer(listen, backend, secret string) (*Server, error) {
 	listener, err := newListener(listen)
 	if err != nil {
 		return nil, err
 	}
 
-	baddr, err := net.ResolveTCPAddr("tcp", backend)
+	pool, err := newBackendPool(backend)
 	if err != nil {
+		listener.Close()
 		return nil, err
 	}
 
 	s := &Server{
 		listener: listener,
-		baddr:    baddr,
+		backend:  pool,
 		secret:   secret,
 		hubs:     make(map[*ServerHub]bool),
+		sessions: make(map[Ticket]*ServerHub),
+		bonds:    make(map[bondKey]*bondGroup),
+		counter:  newTunnelCounter(),
+		quit:     make(chan struct{}),
 	}
 	return s, nil
 }
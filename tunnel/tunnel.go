@@ -8,7 +8,7 @@ import (
 	"net"
 	"sync"
 	"time"
-	mrand "math/rand"
+	"sync/atomic"
 	"crypto/cipher"
 
 	"crypto/sha256"
@@ -19,21 +19,25 @@ import (
 
 const (
 	MaxReadTimeout        = 120 // seconds
-	TunnelPacketSize      = 8192
+	TunnelPacketSize      = 8192    // 老版本协议的最大帧, 也是默认值
+	MaxFrameLimit         = 1 << 20 // 可以配置的最大帧
+	MinFrameSize          = 1 << 10 // 可以配置的最小帧
 	TunnelKeepAlivePeriod = time.Second * 180
 	PASSWORD              = "Through-the-tunnel-I-reach-the-world"
 )
 
 var (
 	TByteOrder        = binary.BigEndian
-	IdGenMux          sync.Mutex
 	TunnelReadTimeout       = uint(60 * 3)
 	LogLevel          uint8 = uint8(1)
-	mpool                   = NewMPool(TunnelPacketSize)
+	mpool                   = NewMPool(256, 1<<10, 4<<10, TunnelPacketSize, 16<<10, 64<<10, 256<<10, MaxFrameLimit)
+	MaxFrameSize            = TunnelPacketSize // 本端支持的最大帧, 握手时取双方的较小值
 	ExitOnError             = true // only for test
 	VerifyCRC               = true //数据CRC校验.
 
-	CipherName string
+	CipherName = DefaultCiphers // 逗号分隔的cipher列表, 按优先顺序. 见z_cipher.go
+
+	TotalStats TrafficStats // 所有tunnel的流量合计, 包括已经关闭的tunnel.
 )
 
 var errPeerClosed = errors.New("errPeerClosed")
@@ -48,7 +52,8 @@ var errPacketId = fmt.Errorf("error PacketId in packet Header")
 type TunnelConn interface {
 	net.Conn
 	Flush() error
-	setKeys(token AuthToken, secret string, client bool)
+	setKeys(token AuthToken, secret, cipher string, client bool)
+	rekey(write bool)
 }
 
 type tnConn struct {
@@ -57,6 +62,9 @@ type tnConn struct {
 	writer *bufio.Writer
 	enc    cipher.Stream
 	dec    cipher.Stream
+	encKey [32]byte // 当前的密钥, 换密钥时由它派生新的密钥. 见z_rekey.go
+	decKey [32]byte
+	cipher string // 握手时协商的cipher
 }
 
 var _ TunnelConn = (*tnConn)(nil) // Verify that *T implements I.
@@ -85,7 +93,8 @@ func (tn *tnConn) Close() error {
 	return tn.Conn.Close()
 }
 
-func (tn *tnConn) setKeys(taa AuthToken, secretStr string, fromClient bool) {
+func (tn *tnConn) setKeys(taa AuthToken, secretStr, cipherName string, fromClient bool) {
+	tn.cipher = cipherName
 
 	var encSecret, decSecret [32]byte
 	//client
@@ -96,25 +105,28 @@ func (tn *tnConn) setKeys(taa AuthToken, secretStr string, fromClient bool) {
 		encSecret, decSecret = decSecret, encSecret
 	}
 
-	func() {
-		encCipher, encKey, err := PickCipher(CipherName, encSecret[:])
-		if err != nil {
-			panic("bad cipher")
-		}
-		encIV := sha256.Sum256(Reverse(encKey))
-		tn.enc = encCipher.Encrypter(Kdf(encIV[:], encCipher.IVSize()))
-	}()
-
-	func() {
-		decCipher, decKey, err := PickCipher(CipherName, decSecret[:])
-		if err != nil {
-			panic("bad cipher")
-		}
-		decIV := sha256.Sum256(Reverse(decKey))
-		tn.dec = decCipher.Decrypter(Kdf(decIV[:], decCipher.IVSize()))
+	tn.setEncKey(encSecret)
+	tn.setDecKey(decSecret)
+}
 
-	}()
+func (tn *tnConn) setEncKey(secret [32]byte) {
+	encCipher, encKey, err := PickCipher(tn.cipher, secret[:])
+	if err != nil {
+		panic("bad cipher")
+	}
+	encIV := sha256.Sum256(Reverse(encKey))
+	tn.enc = encCipher.Encrypter(Kdf(encIV[:], encCipher.IVSize()))
+	tn.encKey = secret
+}
 
+func (tn *tnConn) setDecKey(secret [32]byte) {
+	decCipher, decKey, err := PickCipher(tn.cipher, secret[:])
+	if err != nil {
+		panic("bad cipher")
+	}
+	decIV := sha256.Sum256(Reverse(decKey))
+	tn.dec = decCipher.Decrypter(Kdf(decIV[:], decCipher.IVSize()))
+	tn.decKey = secret
 }
 
 /// tunnel packet Header
@@ -137,31 +149,87 @@ func hCRC(he *Header) uint16 {
 	return crc16.CheckSum(buff)
 }
 
+/// 扩展的packet Header, 握手时协商使用. LinkId和Len都是32位.
+type HeaderExt struct {
+	PacketId  uint16
+	HeaderCRC uint16
+	DataCRC   uint16
+	Flags     uint16 // 位标记: FlagSnappy表示数据经过压缩, 只在协商了压缩时使用. 其他位保留, 必须为0
+	LinkId    uint32
+	Len       uint32
+}
+
+func hCRCExt(he *HeaderExt) uint16 {
+	buff := make([]byte, 14)
+	TByteOrder.PutUint16(buff, he.PacketId)
+	TByteOrder.PutUint16(buff[2:], he.DataCRC)
+	TByteOrder.PutUint16(buff[4:], he.Flags)
+	TByteOrder.PutUint32(buff[6:], he.LinkId)
+	TByteOrder.PutUint32(buff[10:], he.Len)
+	return crc16.CheckSum(buff)
+}
+
+const (
+	headerSize    = 10 // binary.Size(Header{})
+	headerExtSize = 16 // binary.Size(HeaderExt{})
+)
+
 type Tunnel struct {
+	stats     TrafficStats  // 包括Header在内的收发字节数
+	cstats    CompressStats // 发送方向的压缩统计
+	unflushed int64         // 写入之后还没有flush的字节数
+	queued    int64         // 在WritePacket中等待写入或者正在写入的字节数
 	tconn TunnelConn
+	amux  sync.RWMutex // 会话恢复时会替换tconn, 保护其他goroutine读取地址
 	// protect concurrent write. 并发write,flush等等均会导致数据错误.
 	wlock                sync.Mutex
 	werr                 error
 	running              bool
-	lastFlushMs          int64
+	waiting              int32       // 等待wlock的写者数
+	flushArmed           bool        // 延迟flush的定时器已经启动
+	flushTimer           *time.Timer
 	tunId                uint16
 	readPacketIdCounter  uint16
 	writePacketIdCounter uint16
+	ext                  bool  // 使用HeaderExt, 握手成功之后设置
+	maxFrame             int   // 协商之后的最大帧
+	compress             uint8 // 协商之后的压缩算法
+	rekey                bool      // 协商了换密钥
+	rekeyBytes           int64     // 上一次换密钥之后写入的字节数, 持有wlock时修改
+	rekeyTime            time.Time // 上一次换密钥的时间
+	rekeys               int32     // 两个方向换密钥的次数
 }
 
 func newTunnel(conn net.Conn) *Tunnel {
 	var tun Tunnel
-	tun.tconn = &tnConn{conn, bufio.NewReaderSize(conn, TunnelPacketSize*2), bufio.NewWriterSize(conn, TunnelPacketSize*2), nil, nil}
+	tun.tconn = &tnConn{Conn: conn, reader: bufio.NewReaderSize(conn, TunnelPacketSize*2), writer: bufio.NewWriterSize(conn, TunnelPacketSize*2)}
 	tun.running = true
-	go tun.startAutoFlush()
+	tun.maxFrame = TunnelPacketSize
 	return &tun
 }
 
 func (tun *Tunnel) Close() error {
 	tun.wlock.Lock()
 	defer tun.wlock.Unlock()
+	return tun.closeLocked()
+}
+
+/// 不等待wlock, 直接关闭底层连接, 让阻塞的读写立即返回.
+func (tun *Tunnel) shutdown() {
+	tun.amux.RLock()
+	defer tun.amux.RUnlock()
+	if tn, ok := tun.tconn.(*tnConn); ok {
+		tn.Conn.Close()
+	}
+}
+
+/// 调用者持有wlock
+func (tun *Tunnel) closeLocked() error {
 	if tun.running {
 		tun.running = false
+		if tun.flushTimer != nil {
+			tun.flushTimer.Stop()
+		}
 		Warn("%s closed", tun)
 		return tun.tconn.Close()
 	}
@@ -169,39 +237,73 @@ func (tun *Tunnel) Close() error {
 }
 
 func (tun *Tunnel) Flush() error {
-	tun.lastFlushMs = TimeNowMs()
+	atomic.StoreInt64(&tun.unflushed, 0)
 	return tun.tconn.Flush()
 }
 
-func (tun *Tunnel) startAutoFlush() {
-	interval := time.Millisecond * time.Duration(100+mrand.Intn(40))
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
-
-	flushJob := func() bool {
-		tun.wlock.Lock()
-		defer tun.wlock.Unlock()
-		if tun.running && (TimeNowMs()-tun.lastFlushMs > 40) {
-			tun.Flush()
-		}
-		return tun.running
+/// 握手成功之后, 按协商的结果设置tunnel.
+func (tun *Tunnel) setFeatures(f Features) {
+	tun.wlock.Lock()
+	defer tun.wlock.Unlock()
+	tun.ext = f.ExtHeader
+	tun.maxFrame = TunnelPacketSize
+	if f.ExtHeader && f.MaxFrame >= MinFrameSize && f.MaxFrame <= MaxFrameLimit {
+		tun.maxFrame = int(f.MaxFrame)
+	}
+	tun.compress = 0
+	if f.ExtHeader { // 压缩标记在HeaderExt.Flags中
+		tun.compress = f.Compress
 	}
+	tun.rekey = f.Rekey
+	tun.rekeyBytes, tun.rekeyTime = 0, time.Now()
+}
 
-	for range ticker.C {
-		running := flushJob()
-		if !running {
-			break
-		}
+/// 压缩统计
+func (tun *Tunnel) CompressStats() CompressStats {
+	return tun.cstats.Snapshot()
+}
+
+/// 写入之后还没有flush的数据超过该长度时立即flush. 缓冲满了bufio会自己写出, 这里只是不让剩下的零头等待定时器.
+/// 按还没有flush的字节数而不是单个packet的大小判断, 连续写入满帧时才能合并.
+func (tun *Tunnel) flushLimitSize() int64 {
+	return int64(tun.maxFrame) * 8
+}
+
+/// 协商之后的最大link id
+func (tun *Tunnel) maxLinkId() uint32 {
+	if tun.ext {
+		return 0xFFFFFFFF
 	}
+	return 0xFFFF
 }
 
-const flushLimitSize = TunnelPacketSize * 7 / 10
+func (tun *Tunnel) headerSize() int {
+	if tun.ext {
+		return headerExtSize
+	}
+	return headerSize
+}
 
 /// can write concurrently
-func (tun *Tunnel) WritePacket(kid uint16, data []byte, forceFlush bool) (err error) {
+func (tun *Tunnel) WritePacket(kid uint32, data []byte, flush FlushMode) (err error) {
 	defer mpool.Put(data)
 
+	// 在加密之前压缩. 不需要加锁, 压缩算法在握手时已经确定.
+	rawLen, flags := len(data), uint16(0)
+	if tun.compress&compressSnappy != 0 {
+		if enc := compressPacket(data); enc != nil {
+			defer mpool.Put(enc)
+			data, flags = enc, FlagSnappy
+		}
+		tun.cstats.add(rawLen, len(data))
+		TotalCompress.add(rawLen, len(data))
+	}
+
+	atomic.AddInt64(&tun.queued, int64(len(data)))
+	defer atomic.AddInt64(&tun.queued, -int64(len(data)))
+	atomic.AddInt32(&tun.waiting, 1)
 	tun.wlock.Lock()
+	atomic.AddInt32(&tun.waiting, -1)
 	defer tun.wlock.Unlock()
 
 	if tun.werr != nil {
@@ -210,53 +312,86 @@ func (tun *Tunnel) WritePacket(kid uint16, data []byte, forceFlush bool) (err er
 
 	//这些字节,废弃一些字节.
 	if false {
-		dropped := mpool.Get()[0:(4 - tun.writePacketIdCounter%4)]
+		dropped := mpool.Get(int(4 - tun.writePacketIdCounter%4))
 		rand.Read(dropped)
 		if _, err = tun.tconn.Write(dropped); err != nil {
 			tun.werr = err
-			tun.Close()
+			tun.closeLocked()
 			return err
 		}
 		mpool.Put(dropped)
 	}
 
-	// Header
-	dataCRC := crc16.CheckSum(data)
-	header := Header{tun.writePacketIdCounter, 0, dataCRC, kid, uint16(len(data))}
-	header.HeaderCRC = uint16(hCRC(&header))
-	if err = binary.Write(tun.tconn, TByteOrder, header); err != nil {
+	if err = tun.writeFrameLocked(kid, data, flags); err != nil {
 		tun.werr = err
-		tun.Close()
+		tun.closeLocked()
 		return err
 	}
-	tun.writePacketIdCounter += 1
-
-	// data
-	if _, err = tun.tconn.Write(data); err != nil {
+	if err = tun.rekeyLocked(); err != nil {
 		tun.werr = err
-		tun.Close()
+		tun.closeLocked()
 		return err
 	}
 
-	switch {
-	case forceFlush || (!forceFlush && len(data) > flushLimitSize):
-		if err = tun.Flush(); err != nil {
-			tun.werr = err
-			tun.Close()
-			return err
-		}
-	default:
-		// not flush
+	if err = tun.flushAfterWrite(flush); err != nil {
+		tun.werr = err
+		tun.closeLocked()
+		return err
 	}
 
-	Debug("write packet %d", header.PacketId)
+	Debug("write packet %d", tun.writePacketIdCounter-1)
 
 	return nil
 }
 
+/// 写入Header和数据. 调用者持有wlock
+func (tun *Tunnel) writeFrameLocked(kid uint32, data []byte, flags uint16) error {
+	// Header
+	dataCRC := crc16.CheckSum(data)
+	var header interface{}
+	if tun.ext {
+		h := HeaderExt{tun.writePacketIdCounter, 0, dataCRC, flags, kid, uint32(len(data))}
+		h.HeaderCRC = hCRCExt(&h)
+		header = &h
+	} else {
+		h := Header{tun.writePacketIdCounter, 0, dataCRC, uint16(kid), uint16(len(data))}
+		h.HeaderCRC = hCRC(&h)
+		header = &h
+	}
+	if err := binary.Write(tun.tconn, TByteOrder, header); err != nil {
+		return err
+	}
+	tun.writePacketIdCounter += 1
+
+	// data
+	if _, err := tun.tconn.Write(data); err != nil {
+		return err
+	}
+	n := tun.headerSize() + len(data)
+	tun.stats.addOut(n)
+	atomic.AddInt64(&tun.unflushed, int64(n))
+	TotalStats.addOut(n)
+	tun.rekeyBytes += int64(n)
+	return nil
+}
+
 /// can't read concurrently
-func (tun *Tunnel) ReadPacket() (linkId uint16, data []byte, err error) {
-	var h Header
+func (tun *Tunnel) ReadPacket() (linkId uint32, data []byte, err error) {
+	for {
+		if linkId, data, err = tun.readPacket(); err != nil || !tun.isRekeyPacket(linkId, data) {
+			return
+		}
+		// 对端换了密钥, 下一个packet开始使用新的密钥. 不交给hub
+		err = tun.onRekey(data)
+		mpool.Put(data)
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+}
+
+func (tun *Tunnel) readPacket() (linkId uint32, data []byte, err error) {
+	var h HeaderExt
 
 	// 配合心跳ping-pong,检查是否断网
 	// A deadline is an absolute time after which I/O operations
@@ -272,16 +407,28 @@ func (tun *Tunnel) ReadPacket() (linkId uint16, data []byte, err error) {
 
 	//废弃一些字节.
 	if false {
-		dropped := mpool.Get()[0:(4 - tun.readPacketIdCounter%4)]
+		dropped := mpool.Get(int(4 - tun.readPacketIdCounter%4))
 		if _, err = io.ReadFull(tun.tconn, dropped); err != nil {
 			return
 		}
 		mpool.Put(dropped)
 	}
 
-	if err = binary.Read(tun.tconn, TByteOrder, &h); err != nil {
-		Error("ReadPacket: read Header error: %v", err)
-		return
+	var hcrc uint16
+	if tun.ext {
+		if err = binary.Read(tun.tconn, TByteOrder, &h); err != nil {
+			Error("ReadPacket: read Header error: %v", err)
+			return
+		}
+		hcrc = hCRCExt(&h)
+	} else {
+		var h16 Header
+		if err = binary.Read(tun.tconn, TByteOrder, &h16); err != nil {
+			Error("ReadPacket: read Header error: %v", err)
+			return
+		}
+		hcrc = hCRC(&h16)
+		h = HeaderExt{h16.PacketId, h16.HeaderCRC, h16.DataCRC, 0, uint32(h16.LinkId), uint32(h16.Len)}
 	}
 	Debug("ReadPacket read Header: %v", &h)
 
@@ -293,7 +440,6 @@ func (tun *Tunnel) ReadPacket() (linkId uint16, data []byte, err error) {
 	tun.readPacketIdCounter += 1
 
 	if VerifyCRC {
-		hcrc := hCRC(&h)
 		if h.HeaderCRC != hcrc {
 			Error("error HeaderCRC")
 			err = errCRC
@@ -301,16 +447,18 @@ func (tun *Tunnel) ReadPacket() (linkId uint16, data []byte, err error) {
 		}
 	}
 
-	if h.Len > TunnelPacketSize {
+	if h.Len > uint32(tun.maxFrame) {
 		err = errTooLarge
 		return
 	}
 
-	data = mpool.Get()[0:h.Len]
+	data = mpool.Get(int(h.Len))
 	if _, err = io.ReadFull(tun.tconn, data); err != nil {
 		return
 	}
 	Debug("ReadPacket: read data: %d", len(data))
+	tun.stats.addIn(tun.headerSize() + len(data))
+	TotalStats.addIn(tun.headerSize() + len(data))
 
 	if VerifyCRC {
 		dataCRC := crc16.CheckSum(data)
@@ -321,12 +469,50 @@ func (tun *Tunnel) ReadPacket() (linkId uint16, data []byte, err error) {
 		}
 	}
 
+	if h.Flags != 0 {
+		if data, err = decompressPacket(data, h.Flags, tun.compress, tun.maxFrame); err != nil {
+			Error("ReadPacket: decompress failed: %v", err)
+			return
+		}
+	}
+
 	linkId = h.LinkId
 	Debug("ReadPacket: OK")
 	return
 }
 
-func (tun Tunnel) String() string {
+/// 流量计数
+func (tun *Tunnel) Stats() TrafficStats {
+	return tun.stats.Snapshot()
+}
+
+func (tun *Tunnel) String() string {
+	tun.amux.RLock()
+	defer tun.amux.RUnlock()
 	info := fmt.Sprintf("tunnel(%5d, L%s, R%s)", tun.tunId, tun.tconn.LocalAddr(), tun.tconn.RemoteAddr())
 	return info
 }
+
+/// 对端地址. 会话恢复之后是新连接的地址.
+func (tun *Tunnel) remoteAddr() string {
+	tun.amux.RLock()
+	defer tun.amux.RUnlock()
+	return tun.tconn.RemoteAddr().String()
+}
+
+/// 会话恢复: 换成新建立并且完成握手的连接t, 保留流量统计.
+/// 协商的参数必须和原来的相同, 否则已有的link无法继续. 调用时读goroutine已经停止.
+func (tun *Tunnel) adopt(t *Tunnel) bool {
+	tun.wlock.Lock()
+	defer tun.wlock.Unlock()
+	if t.ext != tun.ext || t.maxFrame != tun.maxFrame || t.compress != tun.compress {
+		return false
+	}
+	tun.amux.Lock()
+	tun.tconn = t.tconn
+	tun.amux.Unlock()
+	tun.werr, tun.running, tun.flushArmed = nil, true, false
+	tun.readPacketIdCounter, tun.writePacketIdCounter = t.readPacketIdCounter, t.writePacketIdCounter
+	tun.rekey, tun.rekeyBytes, tun.rekeyTime = t.rekey, 0, time.Now() // 新的连接使用握手的密钥
+	return true
+}
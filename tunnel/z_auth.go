@@ -11,8 +11,6 @@ import (
 	"crypto/rand"
 	"errors"
 	"github.com/jiguorui/crc16"
-	"encoding/hex"
-	"fmt"
 )
 
 const (
@@ -81,9 +79,10 @@ func (t *AuthToken) isComplementary(t1 AuthToken) bool {
 
 /// gotunnel auth algorithm
 type authTaa struct {
-	cipher cipher.Block
-	mac    hash.Hash
-	Token  AuthToken
+	cipher   cipher.Block
+	mac      hash.Hash
+	Token    AuthToken
+	features []byte // 握手时双方附加的扩展, 计入MAC. 见BindFeatures
 }
 
 func NewTaa(secret string) *authTaa {
@@ -106,6 +105,22 @@ func (a *authTaa) GenRandomToken() {
 	a.Token.Timestamp = uint64(SecureRandInt64())
 }
 
+/// 把client提供的扩展和server选择的扩展计入cipher block的MAC.
+/// 它们在helloA和challenge中以明文传输, 被篡改时(比如把cipher列表换成较弱的)两端算出的MAC不同, 握手失败.
+/// 两端都附加了扩展时才调用, 老版本的对端不计入.
+func (a *authTaa) BindFeatures(offered, chosen []byte) {
+	a.features = append(append(a.features[:0], offered...), chosen...)
+}
+
+/// MAC of the encrypted token and the bound features
+func (a *authTaa) sum(src []byte) []byte {
+	a.mac.Write(src[:TaaTokenSize])
+	a.mac.Write(a.features)
+	sign := a.mac.Sum(nil)
+	a.mac.Reset()
+	return sign
+}
+
 /// generate cipher block. EtM mode.
 func (a *authTaa) GenCipherBlock(token *AuthToken) []byte {
 	if token == nil {
@@ -114,20 +129,13 @@ func (a *authTaa) GenCipherBlock(token *AuthToken) []byte {
 
 	dst := make([]byte, TaaBlockSize)
 	a.cipher.Encrypt(dst, token.toBytes())
-	a.mac.Write(dst[:TaaTokenSize])
-	sign := a.mac.Sum(nil)
-	a.mac.Reset()
-
-	copy(dst[TaaTokenSize:], sign)
+	copy(dst[TaaTokenSize:], a.sum(dst))
 	Debug("cipherblock, c:%v t:%v dst:%v", token.Challenge, token.Timestamp, dst)
 	return dst
 }
 
 func (a *authTaa) CheckMAC(src []byte) bool {
-	a.mac.Write(src[:TaaTokenSize])
-	expectedMac := a.mac.Sum(nil)
-	a.mac.Reset()
-	return hmac.Equal(src[TaaTokenSize:], expectedMac)
+	return hmac.Equal(src[TaaTokenSize:], a.sum(src))
 }
 
 /// exchange cipher block
@@ -189,9 +197,7 @@ func newHelloA(secret string) HelloA {
 	rs := make([]byte, 32);
 	rand.Read(rs)
 	salt := sha256.Sum256(rs)
-	str := secret + "," + fmt.Sprintf("%d", now) + "," + hex.EncodeToString(salt[:])
-	Info("helloa str:%s", str)
-	hash := sha256.Sum256([]byte(str))
+	hash := helloHash(secret, now, salt)
 
 	a := HelloA{
 		Now:         now,
@@ -0,0 +1,259 @@
+package tunnel
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/// server的backend可以是多个地址组成的池, 格式同client的server列表: host:port[@weight],...
+/// 每个成员可以加上?proxy=v1|v2|none, 连接之后先写入PROXY protocol的头, 没有设置时使用ProxyProtocol.
+/// 新的link按BackendBalance选择成员, 连接失败时换一个成员重试.
+/// 主动检查: 每HealthCheckInterval连接一次每个成员, 连不上的成员不再分配link, 直到检查成功.
+/// 被动摘除: 连续EjectFailures次连接失败的成员摘除EjectTime.
+/// 所有成员都不可用时仍然按策略尝试全部成员.
+const (
+	BalanceRoundRobin = "roundrobin" // 按权重轮流
+	BalanceLeastConn  = "leastconn"  // 连接数/权重最小
+	BalanceIPHash     = "iphash"     // 按client的IP哈希, 同一个client总是使用同一个成员
+)
+
+var (
+	BackendBalance      = BalanceRoundRobin
+	BackendRetries      = 2                // 连接失败时换成员重试的次数
+	BackendDialTimeout  = time.Second * 5  // 连接成员的超时
+	HealthCheckInterval = time.Second * 5  // 主动检查的间隔, 0表示不检查
+	HealthCheckTimeout  = time.Second * 2  // 主动检查连接的超时
+	EjectFailures       = 3                // 连续失败这么多次之后摘除, 0表示不摘除
+	EjectTime           = time.Second * 30 // 摘除的时间
+)
+
+/// ListBalance returns a list of available backend balance policies
+func ListBalance() string {
+	return strings.Join([]string{BalanceRoundRobin, BalanceLeastConn, BalanceIPHash}, " ")
+}
+
+type backendMember struct {
+	ep       Endpoint
+	proxy    string // PROXY protocol的版本
+	active   int32  // 正在使用的连接数
+	fails    int32  // 连续连接失败的次数
+	down     int32  // 主动检查失败
+	ejectEnd int64  // 摘除到这个时间, ms
+	current  int    // 平滑加权轮询的当前值, 持有pool的mux时修改
+}
+
+func (m *backendMember) available(now int64) bool {
+	return atomic.LoadInt32(&m.down) == 0 && atomic.LoadInt64(&m.ejectEnd) <= now
+}
+
+/// 连接失败, 连续失败太多时摘除.
+func (m *backendMember) failed(err error) {
+	n := atomic.AddInt32(&m.fails, 1)
+	if EjectFailures > 0 && int(n) >= EjectFailures {
+		atomic.StoreInt32(&m.fails, 0)
+		atomic.StoreInt64(&m.ejectEnd, TimeNowMs()+int64(EjectTime/time.Millisecond))
+		WarnEvent("backend_ejected", LogFields{FieldRole: RoleServer, FieldBackend: m.ep.Addr, FieldReason: err})
+	}
+}
+
+type backendPool struct {
+	members []*backendMember
+	mux     sync.Mutex // protect current
+}
+
+func newBackendPool(s string) (*backendPool, error) {
+	var items, proxies []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		proxy := ProxyProtocol
+		if i := strings.Index(item, "?"); i >= 0 {
+			opt := item[i+1:]
+			if !strings.HasPrefix(opt, "proxy=") || !ValidProxy(opt[6:]) {
+				return nil, fmt.Errorf("backend %s: bad option %s", item[:i], opt)
+			}
+			item, proxy = item[:i], opt[6:]
+		}
+		items = append(items, item)
+		proxies = append(proxies, proxy)
+	}
+	eps, err := ParseEndpoints(strings.Join(items, ","))
+	if err != nil {
+		return nil, err
+	}
+	p := &backendPool{}
+	for i, ep := range eps {
+		if ep.Weight == 0 {
+			ep.Weight = 1
+		}
+		p.members = append(p.members, &backendMember{ep: ep, proxy: proxies[i]})
+	}
+	return p, nil
+}
+
+/// 按策略选择一个成员, 跳过tried中的成员. clientIP用于iphash.
+func (p *backendPool) pick(clientIP string, tried map[*backendMember]bool) *backendMember {
+	now := TimeNowMs()
+	var cand []*backendMember
+	for _, m := range p.members {
+		if !tried[m] && m.available(now) {
+			cand = append(cand, m)
+		}
+	}
+	if len(cand) == 0 { // 都不可用时仍然尝试
+		for _, m := range p.members {
+			if !tried[m] {
+				cand = append(cand, m)
+			}
+		}
+	}
+	if len(cand) == 0 {
+		return nil
+	}
+
+	switch BackendBalance {
+	case BalanceLeastConn:
+		best := cand[0]
+		for _, m := range cand[1:] {
+			if int64(atomic.LoadInt32(&m.active))*int64(best.ep.Weight) <
+				int64(atomic.LoadInt32(&best.active))*int64(m.ep.Weight) {
+				best = m
+			}
+		}
+		return best
+	case BalanceIPHash:
+		// 加权的rendezvous hash, 成员变化时只影响用到它的client
+		var best *backendMember
+		bestScore := math.Inf(-1)
+		for _, m := range cand {
+			f := fnv.New64a()
+			f.Write([]byte(clientIP))
+			f.Write([]byte(m.ep.Addr))
+			u := (float64(f.Sum64()>>11) + 0.5) / (1 << 53)
+			if s := -float64(m.ep.Weight) / math.Log(u); s > bestScore {
+				best, bestScore = m, s
+			}
+		}
+		return best
+	default:
+		// 平滑加权轮询
+		p.mux.Lock()
+		defer p.mux.Unlock()
+		total := 0
+		var best *backendMember
+		for _, m := range cand {
+			m.current += m.ep.Weight
+			total += m.ep.Weight
+			if best == nil || m.current > best.current {
+				best = m
+			}
+		}
+		best.current -= total
+		return best
+	}
+}
+
+/// 连接一个成员, 失败时换成员重试. 返回的成员在连接结束之后调用release.
+func (p *backendPool) dial(clientIP string) (conn halfConn, m *backendMember, err error) {
+	tried := make(map[*backendMember]bool)
+	for i := 0; i <= BackendRetries; i++ {
+		if m = p.pick(clientIP, tried); m == nil {
+			return
+		}
+		tried[m] = true
+		d := net.Dialer{Timeout: BackendDialTimeout}
+		var c net.Conn
+		if c, err = d.Dial(m.ep.Network, m.ep.Addr); err == nil {
+			atomic.StoreInt32(&m.fails, 0)
+			atomic.AddInt32(&m.active, 1)
+			return c.(halfConn), m, nil
+		}
+		m.failed(err)
+		WarnEvent("backend_dial_failed", LogFields{FieldRole: RoleServer, FieldBackend: m.ep.Addr,
+			FieldReason: err, "attempt": i + 1})
+	}
+	return
+}
+
+func (p *backendPool) release(m *backendMember) {
+	atomic.AddInt32(&m.active, -1)
+}
+
+/// 定期连接每个成员, 检查是否可用.
+func (p *backendPool) healthCheck(quit <-chan struct{}) {
+	defer Recover()
+	if HealthCheckInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		var wg sync.WaitGroup
+		for _, m := range p.members {
+			wg.Add(1)
+			go func(m *backendMember) {
+				defer wg.Done()
+				m.check()
+			}(m)
+		}
+		wg.Wait()
+	}
+}
+
+/// 连接一次成员, 更新down. 要求PROXY protocol的成员先收到头才接受连接, 检查时发送LOCAL(v1是UNKNOWN).
+func (m *backendMember) check() {
+	c, err := net.DialTimeout(m.ep.Network, m.ep.Addr, HealthCheckTimeout)
+	if err == nil {
+		c.SetWriteDeadline(time.Now().Add(HealthCheckTimeout))
+		err = writeProxyHeader(c, m.proxy, nil, nil)
+		c.Close()
+	}
+	if err == nil {
+		if atomic.SwapInt32(&m.down, 0) != 0 {
+			atomic.StoreInt64(&m.ejectEnd, 0)
+			WarnEvent("backend_up", LogFields{FieldRole: RoleServer, FieldBackend: m.ep.Addr})
+		}
+	} else if atomic.SwapInt32(&m.down, 1) == 0 {
+		WarnEvent("backend_down", LogFields{FieldRole: RoleServer, FieldBackend: m.ep.Addr, FieldReason: err})
+	}
+}
+
+func (p *backendPool) String() string {
+	var l []string
+	for _, m := range p.members {
+		l = append(l, m.ep.Addr)
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
+
+func (p *backendPool) Status(w io.Writer) {
+	now := TimeNowMs()
+	fmt.Fprintf(w, "\n<backend> %s", BackendBalance)
+	for _, m := range p.members {
+		state := "up"
+		if atomic.LoadInt32(&m.down) != 0 {
+			state = "down"
+		} else if !m.available(now) {
+			state = "ejected"
+		}
+		fmt.Fprintf(w, ", %s %s conns %d", m.ep, state, atomic.LoadInt32(&m.active))
+		if m.proxy != ProxyNone {
+			fmt.Fprintf(w, " proxy %s", m.proxy)
+		}
+	}
+}
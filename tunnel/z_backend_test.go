@@ -0,0 +1,160 @@
+package tunnel
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testPool(t *testing.T, s string) *backendPool {
+	p, err := newBackendPool(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func pickAddrs(p *backendPool, clientIP string, n int) (l []string) {
+	for i := 0; i < n; i++ {
+		l = append(l, p.pick(clientIP, nil).ep.Addr)
+	}
+	return
+}
+
+func TestBackendRoundRobin(t *testing.T) {
+	p := testPool(t, "127.0.0.1:1@2,127.0.0.1:2@1")
+	got := pickAddrs(p, "", 6)
+	want := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:1", "127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:1"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("picks %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBackendLeastConn(t *testing.T) {
+	BackendBalance = BalanceLeastConn
+	defer func() { BackendBalance = BalanceRoundRobin }()
+
+	p := testPool(t, "127.0.0.1:1@3,127.0.0.1:2@1")
+	p.members[0].active = 2
+	p.members[1].active = 1
+	if m := p.pick("", nil); m != p.members[0] { // 2/3 < 1/1
+		t.Fatalf("picked %s", m.ep.Addr)
+	}
+	p.members[0].active = 4
+	if m := p.pick("", nil); m != p.members[1] {
+		t.Fatalf("picked %s", m.ep.Addr)
+	}
+	if m := p.pick("", map[*backendMember]bool{p.members[1]: true}); m != p.members[0] {
+		t.Fatal("tried member picked again")
+	}
+}
+
+func TestBackendIPHash(t *testing.T) {
+	BackendBalance = BalanceIPHash
+	defer func() { BackendBalance = BalanceRoundRobin }()
+
+	p := testPool(t, "127.0.0.1:1,127.0.0.1:2,127.0.0.1:3")
+	used := map[*backendMember]bool{}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.5", "10.0.0.6", "10.0.0.7", "10.0.0.8"} {
+		m := p.pick(ip, nil)
+		used[m] = true
+		for i := 0; i < 3; i++ {
+			if again := p.pick(ip, nil); again != m {
+				t.Fatalf("%s moved from %s to %s", ip, m.ep.Addr, again.ep.Addr)
+			}
+		}
+		if other := p.pick(ip, map[*backendMember]bool{m: true}); other == m || other == nil {
+			t.Fatal("retry did not pick another member")
+		}
+	}
+	if len(used) < 2 {
+		t.Fatal("all clients hashed to one member")
+	}
+}
+
+func TestBackendEject(t *testing.T) {
+	defer func(n int, d time.Duration) { EjectFailures, EjectTime = n, d }(EjectFailures, EjectTime)
+	EjectFailures, EjectTime = 2, 100*time.Millisecond
+
+	p := testPool(t, "127.0.0.1:1,127.0.0.1:2")
+	bad := p.members[0]
+	bad.failed(io.EOF)
+	if !bad.available(TimeNowMs()) {
+		t.Fatal("ejected before EjectFailures")
+	}
+	bad.failed(io.EOF)
+	for _, addr := range pickAddrs(p, "", 4) {
+		if addr == bad.ep.Addr {
+			t.Fatal("ejected member picked")
+		}
+	}
+	p.members[1].failed(io.EOF)
+	p.members[1].failed(io.EOF)
+	if m := p.pick("", nil); m == nil { // 都不可用时仍然尝试
+		t.Fatal("nothing picked with all members ejected")
+	}
+	time.Sleep(2 * EjectTime)
+	if !bad.available(TimeNowMs()) {
+		t.Fatal("member not back after EjectTime")
+	}
+}
+
+/// 健康检查按成员的proxy设置发送LOCAL头, 连不上的成员标记为down, 不再分配.
+func TestBackendHealthCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	heads := make(chan []byte, 3)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.SetReadDeadline(time.Now().Add(5 * time.Second))
+			b, _ := io.ReadAll(c)
+			c.Close()
+			heads <- b
+		}
+	}()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	addr := l.Addr().String()
+	v2Local := append(append([]byte{}, proxyV2Sig...), 0x20, 0x00, 0, 0)
+	for _, c := range []struct {
+		proxy string
+		head  []byte
+	}{
+		{ProxyNone, nil},
+		{ProxyV1, []byte("PROXY UNKNOWN\r\n")},
+		{ProxyV2, v2Local},
+	} {
+		p := testPool(t, addr+"?proxy="+c.proxy+","+deadAddr)
+		for _, m := range p.members {
+			m.check()
+		}
+		if got := <-heads; !bytes.Equal(got, c.head) {
+			t.Fatalf("proxy %s: health check sent %q, want %q", c.proxy, got, c.head)
+		}
+		if atomic.LoadInt32(&p.members[0].down) != 0 || atomic.LoadInt32(&p.members[1].down) == 0 {
+			t.Fatalf("proxy %s: wrong member state", c.proxy)
+		}
+		for _, a := range pickAddrs(p, "", 3) {
+			if a != addr {
+				t.Fatal("down member picked")
+			}
+		}
+	}
+}
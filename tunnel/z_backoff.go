@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"errors"
+	mrand "math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/// tunnel连接失败之后的重试间隔.
+/// 网络错误时从RedialMin开始每次加倍, 最多RedialMax; 认证失败时等待RedialAuthFailed, 重试也不会成功, 不要频繁连接server.
+/// 实际等待的时间在[d/2, d)之间随机, 避免多个tunnel同时重连. 本地网络恢复时立即重试网络错误.
+var (
+	RedialMin        = time.Second
+	RedialMax        = time.Minute
+	RedialAuthFailed = time.Minute * 5
+	NetCheckInterval = time.Second * 2 // 检查本地网络地址变化的间隔, 0表示不检查
+)
+
+const (
+	hubStableTime = time.Second * 10        // hub运行超过这个时间才重置重试间隔. 握手之后马上被server关闭的连接算作失败
+	redialFloor   = time.Millisecond * 100 // 重试间隔的下限, RedialMin等设置为0时也不会连续重连
+)
+
+var ErrAuthFailed = errors.New("tunnel authentication failed")
+
+/// 两端的配置不一致(secret, cipher, 要求扩展), 马上重试也不会成功, 按RedialAuthFailed等待.
+func configError(err error) bool {
+	return err == ErrAuthFailed || err == ErrCipherMismatch || err == ErrLegacyPeer
+}
+
+type backoff struct {
+	attempt uint
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
+
+/// 下一次重试之前等待的时间
+func (b *backoff) next(err error) time.Duration {
+	d := RedialAuthFailed
+	if !configError(err) {
+		d = RedialMax
+		if b.attempt < 20 && RedialMin<<b.attempt < RedialMax {
+			d = RedialMin << b.attempt
+		}
+		b.attempt++
+	}
+	if d < redialFloor {
+		d = redialFloor
+	}
+	return d/2 + time.Duration(mrand.Int63n(int64(d/2)))
+}
+
+/// 等待重试. 网络错误时本地网络变化会提前结束等待, quit关闭时立即返回.
+func (b *backoff) wait(err error, quit <-chan struct{}) {
+	d := b.next(err)
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	var changed <-chan struct{}
+	if !configError(err) {
+		changed = netChanged()
+	}
+	select {
+	case <-timer.C:
+	case <-quit:
+	case <-changed:
+		b.reset()
+		InfoEvent("network_changed", LogFields{FieldRole: RoleClient})
+	}
+}
+
+/// 定期检查本地网络地址, 有变化时关闭当前的channel并换一个新的.
+type netWatcher struct {
+	once    sync.Once
+	mux     sync.Mutex
+	changed chan struct{}
+	addrs   string
+}
+
+var netWatch netWatcher
+
+/// 本地网络地址变化(比如网络恢复, 切换了网络)时关闭的channel
+func netChanged() <-chan struct{} {
+	if NetCheckInterval <= 0 {
+		return nil
+	}
+	netWatch.once.Do(func() {
+		netWatch.changed = make(chan struct{})
+		netWatch.addrs = localAddrs()
+		go netWatch.run()
+	})
+	netWatch.mux.Lock()
+	defer netWatch.mux.Unlock()
+	return netWatch.changed
+}
+
+func (w *netWatcher) run() {
+	defer Recover()
+	for {
+		time.Sleep(NetCheckInterval)
+		addrs := localAddrs()
+		w.mux.Lock()
+		if addrs != w.addrs {
+			w.addrs = addrs
+			if addrs != "" { // 地址全部消失时不用重试
+				close(w.changed)
+				w.changed = make(chan struct{})
+			}
+		}
+		w.mux.Unlock()
+	}
+}
+
+/// 本机的非loopback地址, 排序之后拼接
+func localAddrs() string {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return ""
+	}
+	var l []string
+	for _, a := range addrs {
+		if ip, ok := a.(*net.IPNet); ok && !ip.IP.IsLoopback() && !ip.IP.IsLinkLocalUnicast() {
+			l = append(l, ip.String())
+		}
+	}
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
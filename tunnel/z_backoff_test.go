@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+/// 网络错误时间隔加倍到RedialMax, 认证失败时按RedialAuthFailed等待, 不增加重试次数. 实际等待在[d/2, d)之间.
+/// 间隔不小于redialFloor.
+func TestBackoffBounds(t *testing.T) {
+	netErr := errors.New("connection refused")
+	var b backoff
+	for i, d := range []time.Duration{RedialMin, RedialMin * 2, RedialMin * 4} {
+		if got := b.next(netErr); got < d/2 || got >= d {
+			t.Fatalf("attempt %d: %v not in [%v, %v)", i, got, d/2, d)
+		}
+	}
+	for i := 0; i < 30; i++ { // RedialMin<<6已经超过RedialMax
+		if got := b.next(netErr); i >= 3 && (got < RedialMax/2 || got >= RedialMax) {
+			t.Fatalf("capped: %v not in [%v, %v)", got, RedialMax/2, RedialMax)
+		}
+	}
+
+	b.reset()
+	for _, err := range []error{ErrAuthFailed, ErrCipherMismatch} {
+		if got := b.next(err); got < RedialAuthFailed/2 || got >= RedialAuthFailed {
+			t.Fatalf("%v: %v not in [%v, %v)", err, got, RedialAuthFailed/2, RedialAuthFailed)
+		}
+	}
+	if b.attempt != 0 {
+		t.Fatalf("config errors counted as %d attempts", b.attempt)
+	}
+
+	// 设置为0时按redialFloor等待, 不会连续重连
+	rmin, rmax, auth := RedialMin, RedialMax, RedialAuthFailed
+	RedialMin, RedialMax, RedialAuthFailed = 0, 0, 0
+	defer func() { RedialMin, RedialMax, RedialAuthFailed = rmin, rmax, auth }()
+	for _, err := range []error{netErr, ErrAuthFailed} {
+		if got := b.next(err); got < redialFloor/2 || got >= redialFloor {
+			t.Fatalf("zero %v: %v not in [%v, %v)", err, got, redialFloor/2, redialFloor)
+		}
+	}
+}
+
+/// 多个tunnel同时失败时等待的时间不同.
+func TestBackoffJitter(t *testing.T) {
+	seen := map[time.Duration]bool{}
+	for i := 0; i < 20; i++ {
+		var b backoff
+		seen[b.next(nil)] = true
+	}
+	if len(seen) < 10 {
+		t.Fatalf("only %d distinct delays in 20 tries", len(seen))
+	}
+}
+
+/// quit关闭时不再等待.
+func TestBackoffQuit(t *testing.T) {
+	quit := make(chan struct{})
+	close(quit)
+	start := time.Now()
+	var b backoff
+	b.wait(ErrAuthFailed, quit)
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("waited %v after quit", d)
+	}
+}
@@ -0,0 +1,400 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/// 多路捆绑.
+/// 同一个client的所有tunnel组成一个组, 组内的link不属于某一个hub. link的每个packet带有序号,
+/// 由排队最少的tunnel发出, 接收方按序号重新排序. 这样一个link可以同时使用多条线路.
+/// 新建link的CD_LINK_CREATE在组内每个tunnel上各发送一次, 保证任何tunnel上的数据都在CREATE之后到达.
+/// 组内任何一个tunnel断开(且不能恢复)都会丢失数据, 所以组内所有link都随之关闭.
+type BondId [16]byte
+
+func newBondId() (b BondId) {
+	rand.Read(b[:])
+	return
+}
+
+func (b BondId) IsZero() bool {
+	return b == BondId{}
+}
+
+func (b BondId) String() string {
+	return fmt.Sprintf("%x", b[:4])
+}
+
+const (
+	bondHeaderSize = 5    // 捆绑的link的packet前缀: seq(4) + code(1)
+	bondQueueSize  = 64   // 每个tunnel的发送队列
+	bondDoneSecs   = 60   // 结束的link保留的时间, 丢弃迟到的CREATE和数据
+	bondDoneMax    = 1024 // 超过这个数量时清理过期的记录
+	bondWindow     = 256  // 每个tunnel缓存的帧数, 要容纳发送队列和TCP缓冲. 窗口是 tunnel数 × bondWindow × 帧, 见onData
+)
+
+/// 每个link缓存(乱序的和等待交付的合计)的上限, 和帧的大小无关. 否则对端协商大帧就能让server为每个link缓存很多数据
+var BondWindowBytes = 8 << 20
+
+type bondOut struct {
+	id    uint32
+	data  []byte
+	flush FlushMode
+}
+
+/// 组内的一个tunnel, 有独立的发送队列, 由各自的goroutine写入tunnel.
+type bondMember struct {
+	hub    *Hub
+	queue  chan bondOut
+	queued int64 // 队列中的字节数
+	done   chan struct{}
+	dead   int32
+}
+
+func (m *bondMember) run() {
+	defer Recover()
+	for {
+		select {
+		case p := <-m.queue:
+			atomic.AddInt64(&m.queued, -int64(len(p.data)))
+			m.hub.Send(p.id, p.data, p.flush)
+		case <-m.done:
+			for {
+				select {
+				case p := <-m.queue:
+					mpool.Put(p.data)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+/// server按用户和id查找组. id在helloA中是明文, 不能只凭id加入其他用户的组.
+type bondKey struct {
+	user string
+	id   BondId
+}
+
+type bondGroup struct {
+	id   BondId
+	user string // server: 组所属的用户
+
+	mux     sync.Mutex // protect members
+	members []*bondMember
+
+	rwmx   sync.RWMutex // protect links, done
+	links  map[uint32]*Link
+	done   map[uint32]int64
+	nextId uint32
+}
+
+func newBondGroup(id BondId) *bondGroup {
+	return &bondGroup{
+		id:    id,
+		links: make(map[uint32]*Link),
+		done:  make(map[uint32]int64),
+	}
+}
+
+/// hub加入组
+func (g *bondGroup) join(h *Hub) {
+	m := &bondMember{hub: h, queue: make(chan bondOut, bondQueueSize), done: make(chan struct{})}
+	g.mux.Lock()
+	g.members = append(g.members, m)
+	n := len(g.members)
+	g.mux.Unlock()
+	h.bond = g
+	go m.run()
+	InfoEvent("bond_join", h.fields(0).With(LogFields{"bond": g.id, "tunnels": n}))
+}
+
+/// hub断开, 退出组并关闭组内所有link.
+func (g *bondGroup) leave(h *Hub) {
+	g.mux.Lock()
+	for i, m := range g.members {
+		if m.hub == h {
+			atomic.StoreInt32(&m.dead, 1)
+			close(m.done)
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+	g.mux.Unlock()
+
+	g.rwmx.Lock()
+	defer g.rwmx.Unlock()
+	for id, k := range g.links {
+		k.setCloseReason(CloseSideTunnel, "bond_reset")
+		k.closeAll()
+		g.done[id] = TimeNowMs()
+	}
+	g.links = make(map[uint32]*Link)
+}
+
+func (g *bondGroup) empty() bool {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return len(g.members) == 0
+}
+
+func (g *bondGroup) alive() []*bondMember {
+	g.mux.Lock()
+	defer g.mux.Unlock()
+	return append([]*bondMember(nil), g.members...)
+}
+
+/// link的最大数据长度, 组内最小的帧减去前缀
+func (g *bondGroup) frame() int {
+	f := MaxFrameLimit
+	for _, m := range g.alive() {
+		if m.hub.tunnel.maxFrame < f {
+			f = m.hub.tunnel.maxFrame
+		}
+	}
+	return f - bondHeaderSize
+}
+
+func (g *bondGroup) getLink(id uint32) *Link {
+	g.rwmx.RLock()
+	defer g.rwmx.RUnlock()
+	return g.links[id]
+}
+
+func (g *bondGroup) linkCount() int {
+	g.rwmx.RLock()
+	defer g.rwmx.RUnlock()
+	return len(g.links)
+}
+
+/// server收到CREATE时调用. link已经存在或者结束(包括被拒绝)时claimed为false, 忽略其他tunnel上重复的CREATE.
+/// 否则在同一次持有锁时做准入检查并建立link: 其他tunnel上CREATE之后的数据总能找到link.
+/// 被拒绝的link记入done, 不会在其他tunnel上再次检查.
+func (g *bondGroup) claimLink(h *Hub, id uint32) (k *Link, claimed bool, err error) {
+	frame := g.frame()
+	g.rwmx.Lock()
+	defer g.rwmx.Unlock()
+	_, ok := g.links[id]
+	_, done := g.done[id]
+	if ok || done {
+		return nil, false, nil
+	}
+	if err = admitLink(len(g.links)); err != nil {
+		g.done[id] = TimeNowMs()
+		return nil, true, err
+	}
+	return g.newLinkLocked(h, id, frame), true, nil
+}
+
+func (g *bondGroup) deleteLink(id uint32) {
+	g.rwmx.Lock()
+	defer g.rwmx.Unlock()
+	delete(g.links, id)
+	now := TimeNowMs()
+	g.done[id] = now
+	if len(g.done) > bondDoneMax {
+		for i, t := range g.done {
+			if now-t > bondDoneSecs*1000 {
+				delete(g.done, i)
+			}
+		}
+	}
+}
+
+/// client端使用, 组内统一分配id.
+func (g *bondGroup) allocLink(h *Hub) *Link {
+	frame := g.frame()
+	g.rwmx.Lock()
+	defer g.rwmx.Unlock()
+	for {
+		g.nextId++
+		if g.nextId == 0 {
+			g.nextId = 1
+		}
+		if _, ok := g.links[g.nextId]; !ok {
+			break
+		}
+	}
+	return g.newLinkLocked(h, g.nextId, frame)
+}
+
+func (g *bondGroup) newLinkLocked(h *Hub, id uint32, frame int) *Link {
+	InfoEvent("link_new", h.fields(id).With(LogFields{"bond": g.id}))
+	k := newLink(id, frame)
+	k.paths = g.alive()
+	g.links[id] = k
+	return k
+}
+
+/// 在组内每个tunnel上发送CREATE. 之后link只使用这些tunnel, 后来加入的tunnel上可能没有CREATE.
+func (g *bondGroup) createRemote(k *Link) {
+	for _, m := range k.paths {
+		m.hub.sendCreate(k)
+	}
+}
+
+/// 选择排队字节最少的tunnel
+func (g *bondGroup) pick(k *Link) *bondMember {
+	var best *bondMember
+	for _, m := range k.paths {
+		if atomic.LoadInt32(&m.dead) != 0 {
+			continue
+		}
+		if best == nil || atomic.LoadInt64(&m.queued) < atomic.LoadInt64(&best.queued) {
+			best = m
+		}
+	}
+	return best
+}
+
+/// 发送link的数据或者关闭命令, 加上序号放入选中的tunnel的队列.
+func (g *bondGroup) send(k *Link, code uint8, data []byte, flush FlushMode) bool {
+	buf := mpool.Get(bondHeaderSize + len(data))
+	TByteOrder.PutUint32(buf, atomic.AddUint32(&k.outSeq, 1)-1)
+	buf[4] = code
+	copy(buf[bondHeaderSize:], data)
+	if data != nil {
+		mpool.Put(data)
+	}
+
+	m := g.pick(k)
+	if m == nil {
+		mpool.Put(buf)
+		return false
+	}
+	atomic.AddInt64(&m.queued, int64(len(buf)))
+	select {
+	case m.queue <- bondOut{k.id, buf, flush}:
+		return true
+	case <-m.done:
+		mpool.Put(buf)
+		return false
+	}
+}
+
+/// link的窗口: tunnel数 × bondWindow × 帧, 不超过BondWindowBytes
+func bondLinkWindow(k *Link) int {
+	if w := len(k.paths) * bondWindow * k.frame; w < BondWindowBytes {
+		return w
+	}
+	return BondWindowBytes
+}
+
+/// 收到捆绑的link的packet, 按序号交付. 乱序到达的packet先保存, 超出窗口时重置link.
+/// 按顺序的packet放入ready, 由单独的goroutine交付, tunnel的读goroutine不会阻塞在本地连接上,
+/// 否则它后面的packet读不出来, 其他tunnel的packet都成为乱序. 本地连接一直写不完,
+/// 缓存的数据超过窗口时, 所有读goroutine等待交付, 和不捆绑的link一样由tunnel承受背压.
+/// 乱序的和等待交付的数据共用一个窗口, link缓存的数据最多是窗口加上一个packet.
+func (g *bondGroup) onData(h *Hub, id uint32, data []byte) {
+	k := g.getLink(id)
+	if k == nil || len(data) < bondHeaderSize {
+		mpool.Put(data)
+		InfoEvent("link_missing", h.fields(id).With(LogFields{FieldBytes: len(data)}))
+		return
+	}
+
+	k.bondMux.Lock()
+	window := bondLinkWindow(k)
+	for k.buffered+k.pending > window && !k.bondReset {
+		k.drained.Wait()
+	}
+	seq := TByteOrder.Uint32(data)
+	d := int32(seq - k.inSeq)
+	if d < 0 || k.bondReset { // 重复的packet, 或者link已经重置
+		k.bondMux.Unlock()
+		mpool.Put(data)
+		return
+	}
+	if d > 0 {
+		if k.buffered += len(data); k.buffered > window {
+			g.resetLocked(h, k)
+			k.bondMux.Unlock()
+			mpool.Put(data)
+			return
+		}
+		if k.reorder == nil {
+			k.reorder = make(map[uint32][]byte)
+		}
+		k.reorder[seq] = data
+		k.bondMux.Unlock()
+		return
+	}
+	for data != nil {
+		k.inSeq++
+		k.ready = append(k.ready, data)
+		k.pending += len(data)
+		if data = k.reorder[k.inSeq]; data != nil {
+			delete(k.reorder, k.inSeq)
+			k.buffered -= len(data)
+		}
+	}
+	if !k.delivering {
+		k.delivering = true
+		go h.deliverReady(k)
+	}
+	k.bondMux.Unlock()
+}
+
+/// 按顺序交付ready中的packet, 交付完时结束. 交付可能阻塞在writeChannel, 不持有bondMux.
+func (h *Hub) deliverReady(k *Link) {
+	defer Recover()
+	k.bondMux.Lock()
+	for len(k.ready) > 0 {
+		batch := k.ready
+		k.ready = nil
+		k.bondMux.Unlock()
+		n := 0
+		for _, p := range batch {
+			n += len(p)
+			h.deliver(k, p)
+		}
+		k.bondMux.Lock()
+		k.pending -= n
+		k.drained.Broadcast()
+	}
+	k.delivering = false
+	k.bondMux.Unlock()
+}
+
+/// 乱序的数据超出窗口: 某个tunnel停滞, 或者对端发送了错误的序号. 丢弃缓存并关闭link, 通知对端.
+func (g *bondGroup) resetLocked(h *Hub, k *Link) {
+	WarnEvent("bond_window_exceeded", h.fields(k.id).With(LogFields{"bond": g.id, FieldBytes: k.buffered}))
+	k.bondReset = true
+	for seq, p := range k.reorder {
+		k.buffered -= len(p)
+		mpool.Put(p)
+		delete(k.reorder, seq)
+	}
+	for _, p := range k.ready {
+		k.pending -= len(p)
+		mpool.Put(p)
+	}
+	k.ready = nil
+	k.drained.Broadcast()
+	k.setCloseReason(CloseSideTunnel, "bond_window")
+	go func() { // 发送可能阻塞, 不在读goroutine中
+		g.send(k, CD_LINK_CLOSE, nil, FlushIdle)
+		k.closeAll()
+	}()
+}
+
+/// 按顺序交付一个packet
+func (h *Hub) deliver(k *Link, data []byte) {
+	code := data[4]
+	if code != CD_LINK_DATA {
+		mpool.Put(data)
+		h.onLinkCmd(k, code)
+		return
+	}
+	payload := mpool.Get(len(data) - bondHeaderSize)
+	copy(payload, data[bondHeaderSize:])
+	mpool.Put(data)
+	k.writeChannel(payload)
+}
+
+func (g *bondGroup) String() string {
+	return fmt.Sprintf("bond(%s) tunnels(%d), links(%d)", g.id, len(g.alive()), g.linkCount())
+}
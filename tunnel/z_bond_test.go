@@ -0,0 +1,319 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+/// 组内有paths个tunnel的link, 对端已经关闭, 重置时的CLOSE不会阻塞.
+func newBondTestLink(t *testing.T, paths, frame int) (*Hub, *bondGroup, *Link) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	h := newHub(newTunnel(c1), RoleServer)
+	g := newBondGroup(newBondId())
+	h.bond = g
+	k := newLink(1, frame)
+	for i := 0; i < paths; i++ {
+		m := &bondMember{hub: h, done: make(chan struct{})}
+		close(m.done)
+		k.paths = append(k.paths, m)
+	}
+	g.links[k.id] = k
+	return h, g, k
+}
+
+func bondPacket(seq uint32, payload byte) []byte {
+	p := mpool.Get(bondHeaderSize + 1)
+	TByteOrder.PutUint32(p, seq)
+	p[4] = CD_LINK_DATA
+	p[5] = payload
+	return p
+}
+
+func expectDelivered(t *testing.T, k *Link, from, to int) {
+	for i := from; i < to; i++ {
+		select {
+		case p := <-k.wchannel:
+			if len(p) != 1 || p[0] != byte(i) {
+				t.Fatalf("packet %d: got %v", i, p)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("packet %d not delivered", i)
+		}
+	}
+}
+
+/// 乱序到达的packet按序号交付, 重复的packet丢弃.
+func TestBondReorder(t *testing.T) {
+	h, g, k := newBondTestLink(t, 2, 1024)
+	for _, seq := range []uint32{2, 0, 3, 1, 0, 5, 4, 2} {
+		g.onData(h, k.id, bondPacket(seq, byte(seq)))
+	}
+	expectDelivered(t, k, 0, 6)
+	if len(k.wchannel) != 0 || len(k.reorder) != 0 || k.buffered != 0 {
+		t.Fatalf("left: channel %d, reorder %d, buffered %d", len(k.wchannel), len(k.reorder), k.buffered)
+	}
+}
+
+/// 交付阻塞在writeChannel时, 其他tunnel的packet不会阻塞读goroutine.
+func TestBondDeliverNotBlocking(t *testing.T) {
+	h, g, k := newBondTestLink(t, 2, 1024)
+	n := cap(k.wchannel) + 1
+	go func() {
+		for i := 0; i < n; i++ {
+			g.onData(h, k.id, bondPacket(uint32(i), byte(i)))
+		}
+	}()
+	for len(k.wchannel) < cap(k.wchannel) {
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan struct{})
+	go func() {
+		g.onData(h, k.id, bondPacket(uint32(n), byte(n)))
+		g.onData(h, k.id, bondPacket(uint32(n+2), byte(n+2)))
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reader blocked by a stalled delivery")
+	}
+	g.onData(h, k.id, bondPacket(uint32(n+1), byte(n+1)))
+	expectDelivered(t, k, 0, n+3)
+}
+
+/// 本地连接一直写不完, 等待交付的数据超过窗口之后读goroutine等待, 不重置link.
+func TestBondBackpressure(t *testing.T) {
+	const frame = 16
+	h, g, k := newBondTestLink(t, 2, frame)
+	window := 2 * bondWindow * frame
+	n := cap(k.wchannel) + 1 + window/(bondHeaderSize+1) + 10
+	go func() { // 交付阻塞在writeChannel
+		for i := 0; i <= cap(k.wchannel); i++ {
+			g.onData(h, k.id, bondPacket(uint32(i), byte(i)))
+		}
+	}()
+	for len(k.wchannel) < cap(k.wchannel) {
+		time.Sleep(time.Millisecond)
+	}
+	var fed int32
+	done := make(chan struct{})
+	go func() {
+		for i := cap(k.wchannel) + 1; i < n; i++ {
+			g.onData(h, k.id, bondPacket(uint32(i), byte(i)))
+			atomic.AddInt32(&fed, 1)
+		}
+		close(done)
+	}()
+	for last := int32(-1); last != atomic.LoadInt32(&fed); {
+		last = atomic.LoadInt32(&fed)
+		time.Sleep(50 * time.Millisecond)
+	}
+	select {
+	case <-done:
+		t.Fatal("reader did not wait for a stalled delivery")
+	default:
+	}
+	k.bondMux.Lock()
+	reset, pending := k.bondReset, k.pending
+	k.bondMux.Unlock()
+	if reset || pending <= window {
+		t.Fatalf("reset %v, pending %d, window %d", reset, pending, window)
+	}
+	expectDelivered(t, k, 0, n)
+	<-done
+}
+
+/// 缺少的packet一直不到, 缓存超过 tunnel数 × 窗口 × 帧 时重置link.
+func TestBondWindowExceeded(t *testing.T) {
+	const frame = 16
+	h, g, k := newBondTestLink(t, 2, frame)
+	limit := 2 * bondWindow * frame
+	seq := uint32(1) // 0一直不到
+	for buffered := 0; buffered <= limit; buffered += bondHeaderSize + 1 {
+		if k.bondReset {
+			t.Fatalf("reset at %d bytes, limit %d", buffered, limit)
+		}
+		g.onData(h, k.id, bondPacket(seq, 0))
+		seq++
+	}
+	if !k.bondReset || len(k.reorder) != 0 {
+		t.Fatalf("not reset: reorder %d, buffered %d", len(k.reorder), k.buffered)
+	}
+	g.onData(h, k.id, bondPacket(0, 0)) // 重置之后的packet丢弃
+	closed := func() bool {
+		k.lock.Lock()
+		defer k.lock.Unlock()
+		return k.writeClosed && k.closeReason == "bond_window"
+	}
+	for i := 0; i < 100 && !closed(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !closed() || len(k.wchannel) != 0 {
+		t.Fatalf("link not closed: channel %d, reason %q", len(k.wchannel), k.closeReason)
+	}
+}
+
+/// 被准入检查拒绝的CREATE记入done, 其他tunnel上迟到的CREATE不会再建立link.
+func TestBondRejectedCreate(t *testing.T) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	go func() { // 丢弃发给client的命令
+		b := make([]byte, 1024)
+		for {
+			if _, err := c2.Read(b); err != nil {
+				return
+			}
+		}
+	}()
+	sh := newServerHub(newTunnel(c1), nil)
+	g := newBondGroup(newBondId())
+	sh.bond = g
+	g.links[1] = newLink(1, 1024)
+
+	SetQuotas(Quotas{LinksPerHub: 1})
+	defer SetQuotas(Quotas{})
+	sh.onCtrl(Ctrl{CD_LINK_CREATE, 2}, nil)
+	if _, done := g.done[2]; !done {
+		t.Fatal("rejected link not recorded")
+	}
+	SetQuotas(Quotas{})
+	sh.onCtrl(Ctrl{CD_LINK_CREATE, 2}, nil) // 另一个tunnel上的CREATE
+	if g.getLink(2) != nil {
+		t.Fatal("rejected link created by a duplicate CREATE")
+	}
+}
+
+/// 两个tunnel同时收到CREATE, 被忽略的一方紧接着收到的数据也属于已经建立的link, 不会丢失.
+func TestBondCreateThenData(t *testing.T) {
+	g := newBondGroup(newBondId())
+	var hubs []*Hub
+	for i := 0; i < 2; i++ {
+		c1, c2 := net.Pipe()
+		t.Cleanup(func() { c1.Close(); c2.Close() })
+		hubs = append(hubs, newHub(newTunnel(c1), RoleServer))
+	}
+	const links = 200
+	var wg sync.WaitGroup
+	for id := uint32(1); id <= links; id++ {
+		for i, h := range hubs {
+			wg.Add(1)
+			go func(h *Hub, id uint32, second bool) {
+				defer wg.Done()
+				if _, claimed, _ := g.claimLink(h, id); claimed {
+					releaseLink()
+				}
+				if second {
+					g.onData(h, id, bondPacket(0, 0))
+				}
+			}(h, id, i == 1)
+		}
+	}
+	wg.Wait()
+	for id := uint32(1); id <= links; id++ {
+		k := g.getLink(id)
+		if k == nil {
+			t.Fatalf("link %d not created", id)
+		}
+		k.bondMux.Lock()
+		seq := k.inSeq
+		k.bondMux.Unlock()
+		if seq != 1 {
+			t.Fatalf("link %d: data after CREATE dropped", id)
+		}
+	}
+}
+
+/// 大帧时窗口不超过BondWindowBytes
+func TestBondWindowBytes(t *testing.T) {
+	_, _, k := newBondTestLink(t, 8, MaxFrameLimit)
+	if w := bondLinkWindow(k); w != BondWindowBytes {
+		t.Fatalf("window %d, want %d", w, BondWindowBytes)
+	}
+	_, _, k = newBondTestLink(t, 2, 16)
+	if w := bondLinkWindow(k); w != 2*bondWindow*16 {
+		t.Fatalf("window %d, want %d", w, 2*bondWindow*16)
+	}
+}
+
+/// 以secret完成握手, 要求加入bond组. server处理连接结束时调用wg.Done.
+func joinBond(t *testing.T, s *Server, wg *sync.WaitGroup, secret string, bond BondId) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c2.Close() }) // 在Stop之前, server不会阻塞在写入
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.handleConn(c1, "127.0.0.1", nil)
+	}()
+
+	tun := newTunnel(c2)
+	local := localFeatures()
+	local.Bond = bond
+	offered := local.toBytes()
+	helloA := newHelloA(secret)
+	if err := tun.WritePacket(0, append(helloA.toBytes(), offered...), FlushNow); err != nil {
+		t.Fatal(err)
+	}
+	_, helloB, err := tun.ReadPacket()
+	if err != nil || len(helloB) <= TaaBlockSize {
+		t.Fatalf("challenge: %d bytes, %v", len(helloB), err)
+	}
+	taa := NewTaa(secret)
+	taa.BindFeatures(offered, helloB[TaaBlockSize:])
+	helloC, err := taa.ExchangeCipherBlock(helloB[:TaaBlockSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.WritePacket(0, helloC, FlushNow); err != nil {
+		t.Fatal(err)
+	}
+}
+
+/// bond id在helloA中是明文. 其他用户使用同样的id不会加入原来的组.
+func TestBondOtherUser(t *testing.T) {
+	ExitOnError = false
+	s, err := NewServer("127.0.0.1:0", "127.0.0.1:1", "user alice secret-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ExtraSecrets = []string{"user mallory secret-m"}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		s.Stop()
+		s.listener.Close()
+		wg.Wait() // hub读取失败时调用Error
+		ExitOnError = true
+	})
+
+	groups := func() map[bondKey]int {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		m := map[bondKey]int{}
+		for key, g := range s.bonds {
+			m[key] = len(g.alive())
+		}
+		return m
+	}
+	wait := func(want int) map[bondKey]int {
+		for i := 0; i < 100; i++ {
+			if m := groups(); len(m) == want {
+				return m
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("groups %v, want %d", groups(), want)
+		return nil
+	}
+
+	id := newBondId()
+	joinBond(t, s, &wg, "secret-a", id)
+	wait(1)
+	joinBond(t, s, &wg, "secret-m", id)
+	m := wait(2)
+	if m[bondKey{"alice", id}] != 1 || m[bondKey{"mallory", id}] != 1 {
+		t.Fatalf("groups %v", m)
+	}
+}
@@ -208,3 +208,82 @@ func Kdf(password []byte, keyLen int) []byte {
 	}
 	return b[:keyLen]
 }
+
+///-------------------------------------------------
+/// 协商cipher.
+/// CipherName是逗号分隔的列表. client在握手时按顺序提供自己的列表(featCipher), server按自己列表的顺序
+/// 选择第一个client也支持的cipher, 没有共同的cipher时回复空值并关闭连接, 两端都报告ErrCipherMismatch.
+/// 列表和选择都计入握手的MAC(BindFeatures), 中间人不能把它们换成较弱的cipher.
+/// 对端是老版本时使用列表的第一个. DUMMY和RC4不安全, 只有设置了AllowInsecureCipher才能使用.
+const DefaultCiphers = "CHACHA20IETF,AES-256-CTR,AES-128-CTR"
+
+var AllowInsecureCipher bool
+
+var insecureCiphers = map[string]bool{"DUMMY": true, "RC4-128": true, "RC4-256": true}
+
+var ErrCipherMismatch = errors.New("cipher mismatch")
+
+/// 解析逗号分隔的cipher列表, 检查是否支持, 以及不安全的cipher是否允许使用.
+func ParseCiphers(s string) ([]string, error) {
+	var l []string
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.ToUpper(strings.TrimSpace(name)); name == "" {
+			continue
+		}
+		if _, ok := streamList[name]; !ok {
+			return nil, errors.New("cipher not supported: " + name)
+		}
+		if insecureCiphers[name] && !AllowInsecureCipher {
+			return nil, errors.New("insecure cipher " + name + " needs to be allowed explicitly")
+		}
+		l = append(l, name)
+	}
+	if len(l) == 0 {
+		return nil, ErrCipherNotSupported
+	}
+	if n := len(strings.Join(l, ",")); n > maxFeatureLen { // 握手时放在一个featCipher中
+		return nil, errors.New("cipher list too long: " + strconv.Itoa(n) + " bytes")
+	}
+	return l, nil
+}
+
+/// 本端的cipher列表. 启动时已经用ParseCiphers检查过.
+func localCiphers() []string {
+	l, _ := ParseCiphers(CipherName)
+	return l
+}
+
+/// server按自己的顺序选择client也支持的cipher, 没有时返回空
+func chooseCipher(local, offered []string) string {
+	for _, name := range local {
+		for _, o := range offered {
+			if name == o {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+/// client检查server选择的cipher. server的回复没有认证, 必须是本端提供的cipher, 否则按不匹配处理.
+/// 老版本的server没有回复cipher, 使用本端列表的第一个.
+func checkChosenCipher(f Features) error {
+	if !f.hasCiphers {
+		return nil
+	}
+	if len(f.Ciphers) == 0 || chooseCipher(f.Ciphers[:1], localCiphers()) == "" {
+		return ErrCipherMismatch
+	}
+	return nil
+}
+
+/// 握手之后使用的cipher. 对端没有协商cipher时使用本端列表的第一个.
+func (f Features) cipher() string {
+	if f.hasCiphers && len(f.Ciphers) > 0 {
+		return f.Ciphers[0]
+	}
+	if l := localCiphers(); len(l) > 0 {
+		return l[0]
+	}
+	return ""
+}
@@ -0,0 +1,72 @@
+package tunnel
+
+import "testing"
+
+func TestChooseCipher(t *testing.T) {
+	local := []string{"CHACHA20IETF", "AES-256-CTR", "AES-128-CTR"}
+	cases := []struct {
+		offered []string
+		want    string
+	}{
+		{[]string{"AES-128-CTR", "CHACHA20IETF"}, "CHACHA20IETF"}, // server的顺序优先
+		{[]string{"AES-128-CTR"}, "AES-128-CTR"},
+		{[]string{"AES-128-CFB", "RC4-128"}, ""},
+		{nil, ""},
+	}
+	for _, c := range cases {
+		if got := chooseCipher(local, c.offered); got != c.want {
+			t.Errorf("chooseCipher(%v) = %q, want %q", c.offered, got, c.want)
+		}
+	}
+}
+
+func setCipherName(t *testing.T, name string) {
+	old := CipherName
+	CipherName = name
+	t.Cleanup(func() { CipherName = old })
+}
+
+/// 老版本的对端没有附加cipher列表, 两端都使用本端列表的第一个.
+func TestCipherOldPeer(t *testing.T) {
+	setCipherName(t, "AES-256-CTR,AES-128-CTR")
+	f := localFeatures().intersect(Features{ExtHeader: true})
+	if f.hasCiphers || f.cipher() != "AES-256-CTR" {
+		t.Fatalf("server with old client: %v %q", f.hasCiphers, f.cipher())
+	}
+	var old Features // 老版本的server没有回复扩展
+	if err := checkChosenCipher(old); err != nil || old.cipher() != "AES-256-CTR" {
+		t.Fatalf("client with old server: %v %q", err, old.cipher())
+	}
+}
+
+func TestCipherNegotiate(t *testing.T) {
+	setCipherName(t, "AES-128-CTR,CHACHA20IETF")
+	client := localFeatures()
+	setCipherName(t, "CHACHA20IETF,AES-256-CTR")
+	reply := localFeatures().intersect(client)
+	if reply.cipher() != "CHACHA20IETF" {
+		t.Fatalf("chosen %v", reply.Ciphers)
+	}
+	setCipherName(t, "AES-128-CTR,CHACHA20IETF")
+	if err := checkChosenCipher(reply); err != nil {
+		t.Fatalf("client rejected %v: %v", reply.Ciphers, err)
+	}
+}
+
+/// server回复空列表, 或者client没有提供的cipher, client都报告不匹配.
+func TestCipherMismatch(t *testing.T) {
+	setCipherName(t, "AES-128-CTR")
+	client := localFeatures()
+	setCipherName(t, "CHACHA20IETF")
+	reply := localFeatures().intersect(client)
+	if !reply.hasCiphers || len(reply.Ciphers) != 0 {
+		t.Fatalf("server chose %v", reply.Ciphers)
+	}
+	setCipherName(t, "AES-128-CTR")
+	for _, chosen := range [][]string{nil, {"CHACHA20IETF"}, {"BLOWFISH"}} {
+		f := Features{Ciphers: chosen, hasCiphers: true}
+		if err := checkChosenCipher(f); err != ErrCipherMismatch {
+			t.Errorf("server chose %v: %v, want ErrCipherMismatch", chosen, err)
+		}
+	}
+}
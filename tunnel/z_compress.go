@@ -0,0 +1,118 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/golang/snappy"
+)
+
+const (
+	CompressNone   = "none"
+	CompressSnappy = "snappy"
+)
+
+/// 握手时协商的压缩算法, 位掩码.
+const (
+	compressSnappy uint8 = 1 << 0
+)
+
+/// HeaderExt.Flags
+const (
+	FlagSnappy uint16 = 1 << 0 // 数据经过snappy压缩
+)
+
+const minCompressSize = 128 // 太短的数据不压缩
+
+var (
+	Compression = CompressNone // 本端是否使用压缩. 双方都开启时才生效.
+
+	errBadFlags      = errors.New("unknown flags in packet Header")
+	errNotNegotiated = errors.New("compressed packet but compression not negotiated")
+
+	TotalCompress CompressStats // 所有tunnel的压缩统计
+)
+
+/// 压缩统计. Raw是尝试压缩的原始字节数, Wire是这些数据实际发送的字节数.
+type CompressStats struct {
+	RawBytes  uint64
+	WireBytes uint64
+}
+
+func (s *CompressStats) add(raw, wire int) {
+	atomic.AddUint64(&s.RawBytes, uint64(raw))
+	atomic.AddUint64(&s.WireBytes, uint64(wire))
+}
+
+func (s *CompressStats) Snapshot() CompressStats {
+	return CompressStats{
+		RawBytes:  atomic.LoadUint64(&s.RawBytes),
+		WireBytes: atomic.LoadUint64(&s.WireBytes),
+	}
+}
+
+/// 压缩率: 发送字节数/原始字节数
+func (s CompressStats) Ratio() float64 {
+	if s.RawBytes == 0 {
+		return 1
+	}
+	return float64(s.WireBytes) / float64(s.RawBytes)
+}
+
+func (s CompressStats) String() string {
+	return fmt.Sprintf("compress %dB -> %dB (%.1f%%)", s.RawBytes, s.WireBytes, s.Ratio()*100)
+}
+
+/// 本端希望使用的压缩算法
+func localCompress() uint8 {
+	if Compression == CompressSnappy {
+		return compressSnappy
+	}
+	return 0
+}
+
+/// 压缩一个packet. 压缩效果不明显(节省不到1/8)时返回nil, 按原始数据发送.
+func compressPacket(data []byte) []byte {
+	if len(data) < minCompressSize {
+		return nil
+	}
+	buf := mpool.Get(snappy.MaxEncodedLen(len(data)))
+	enc := snappy.Encode(buf, data)
+	if len(enc) > len(data)*7/8 {
+		mpool.Put(buf)
+		return nil
+	}
+	return enc
+}
+
+/// 解压一个packet, 释放原来的data. compress是握手时协商的压缩算法, 没有协商的压缩是协议错误.
+func decompressPacket(data []byte, flags uint16, compress uint8, maxFrame int) ([]byte, error) {
+	switch flags {
+	case 0:
+		return data, nil
+	case FlagSnappy:
+		if compress&compressSnappy == 0 {
+			mpool.Put(data)
+			return nil, errNotNegotiated
+		}
+	default:
+		mpool.Put(data)
+		return nil, errBadFlags
+	}
+
+	defer mpool.Put(data)
+	n, err := snappy.DecodedLen(data)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxFrame {
+		return nil, errTooLarge
+	}
+	out := mpool.Get(n)
+	if _, err = snappy.Decode(out, data); err != nil {
+		mpool.Put(out)
+		return nil, err
+	}
+	return out, nil
+}
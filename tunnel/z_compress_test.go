@@ -0,0 +1,27 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+/// 没有协商压缩的一端收到FlagSnappy是协议错误.
+func TestCompressNotNegotiated(t *testing.T) {
+	ExitOnError = false
+	t.Cleanup(func() { ExitOnError = true })
+
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	w, r := newTunnel(c1), newTunnel(c2)
+	w.setFeatures(Features{ExtHeader: true, Compress: compressSnappy})
+	r.setFeatures(Features{ExtHeader: true})
+
+	data := bytes.Repeat([]byte("compressible "), 300)
+	buf := mpool.Get(len(data))
+	copy(buf, data)
+	go w.WritePacket(1, buf, FlushNow)
+	if _, _, err := r.ReadPacket(); err != errNotNegotiated {
+		t.Fatalf("err %v, want errNotNegotiated", err)
+	}
+}
@@ -0,0 +1,198 @@
+package tunnel
+
+import (
+	"errors"
+	"strings"
+)
+
+/// 握手时协商的扩展能力.
+/// 以TLV的形式附加在helloA和challenge之后: magic(4) + [tag(1) len(1) value(len)]...
+/// 老版本的server不解析helloA的内容, 老版本的client收到的challenge也没有附加数据, 所以新老版本可以互通.
+const featuresMagic uint32 = 0x444b5846 // "DKXF"
+
+const maxFeatureLen = 255 // value的最大长度
+
+/// 对端没有附加扩展时按老版本处理, 不使用rekey, 压缩, cipher协商等. 中间人去掉扩展也会降级,
+/// 所以总是输出警告; RequireFeatures时拒绝老版本的对端.
+var RequireFeatures bool
+
+var ErrLegacyPeer = errors.New("peer did not negotiate protocol features")
+
+/// 对端是老版本时调用. RequireFeatures时返回ErrLegacyPeer.
+func legacyPeer(f LogFields) error {
+	if RequireFeatures {
+		WarnEvent("tunnel_rejected", f.With(LogFields{FieldReason: ErrLegacyPeer}))
+		return ErrLegacyPeer
+	}
+	WarnEvent("legacy_peer", f)
+	return nil
+}
+
+const (
+	featExtHeader uint8 = 1  // 使用HeaderExt, 32位的LinkId和Len
+	featMaxFrame  uint8 = 2  // 最大帧, uint32. 需要HeaderExt
+	featCompress  uint8 = 3  // 压缩算法, uint8位掩码. 需要HeaderExt
+	featResume    uint8 = 4  // 会话恢复, 16字节的ticket. 需要HeaderExt
+	featBond      uint8 = 5  // 多路捆绑, 16字节的组id. 需要HeaderExt
+	featAddr      uint8 = 6  // CD_LINK_CREATE附带本地连接的地址, 见z_proxyproto.go
+	featDirect    uint8 = 7  // 透明代理, server按CD_LINK_CREATE附带的目的地址连接. 见z_transparent.go
+	featRekey     uint8 = 8  // 换密钥, CD_REKEY. 需要HeaderExt. 见z_rekey.go
+	featCipher    uint8 = 9  // cipher列表, 逗号分隔. server回复选择的cipher, 空表示没有共同的cipher. 见z_cipher.go
+	featRejected  uint8 = 10 // 认识CD_LINK_CLOSE_Rejected. 老版本的client收到的是CD_LINK_CLOSE
+)
+
+type Features struct {
+	ExtHeader bool
+	MaxFrame  uint32 // 0表示使用TunnelPacketSize
+	Compress  uint8  // 压缩算法, 位掩码
+	Resume    bool   // 支持会话恢复
+	Ticket    Ticket // client: 要恢复的会话, 全0表示新会话. server: 本次连接所属的会话
+	Bond      BondId // 多路捆绑的组, 全0表示不捆绑. server回复相同的id表示同意
+	Addr      bool   // 支持CD_LINK_CREATE附带地址
+	Direct    bool   // client: 透明代理模式. server: 允许直接连接目的地址
+	Rekey     bool   // 支持CD_REKEY
+	Rejected  bool   // 支持CD_LINK_CLOSE_Rejected
+
+	Ciphers    []string // client: 提供的cipher, 按优先顺序. server: 选择的cipher, 空表示不匹配
+	hasCiphers bool     // 附加了featCipher
+}
+
+/// 本端支持的扩展
+func localFeatures() Features {
+	return Features{
+		ExtHeader: true,
+		MaxFrame:  uint32(MaxFrameSize),
+		Compress:  localCompress(),
+		Resume:    ResumeTimeout > 0,
+		Addr:      true,
+		Direct:    len(DirectAllowed) > 0,
+		Rekey:     true,
+		Rejected:  true,
+
+		Ciphers:    localCiphers(),
+		hasCiphers: true,
+	}
+}
+
+func (f Features) toBytes() []byte {
+	buf := make([]byte, 4, 64)
+	TByteOrder.PutUint32(buf, featuresMagic)
+	if f.ExtHeader {
+		buf = append(buf, featExtHeader, 0)
+	}
+	if f.MaxFrame > 0 {
+		buf = append(buf, featMaxFrame, 4, 0, 0, 0, 0)
+		TByteOrder.PutUint32(buf[len(buf)-4:], f.MaxFrame)
+	}
+	if f.Compress != 0 {
+		buf = append(buf, featCompress, 1, f.Compress)
+	}
+	if f.Resume {
+		buf = append(buf, featResume, byte(len(f.Ticket)))
+		buf = append(buf, f.Ticket[:]...)
+	}
+	if !f.Bond.IsZero() {
+		buf = append(buf, featBond, byte(len(f.Bond)))
+		buf = append(buf, f.Bond[:]...)
+	}
+	if f.Addr {
+		buf = append(buf, featAddr, 0)
+	}
+	if f.Direct {
+		buf = append(buf, featDirect, 0)
+	}
+	if f.Rekey {
+		buf = append(buf, featRekey, 0)
+	}
+	if f.Rejected {
+		buf = append(buf, featRejected, 0)
+	}
+	if f.hasCiphers {
+		l := strings.Join(f.Ciphers, ",")
+		if len(l) > maxFeatureLen { // ParseCiphers已经检查过, 不会发生
+			panic("cipher list too long")
+		}
+		buf = append(buf, featCipher, byte(len(l)))
+		buf = append(buf, l...)
+	}
+	return buf
+}
+
+/// 解析附加的扩展. 没有附加数据或者格式错误时ok为false, 按老版本协议处理.
+func parseFeatures(b []byte) (f Features, ok bool) {
+	if len(b) < 4 || TByteOrder.Uint32(b) != featuresMagic {
+		return f, false
+	}
+	b = b[4:]
+	for len(b) >= 2 {
+		tag, n := b[0], int(b[1])
+		if len(b) < 2+n {
+			return Features{}, false
+		}
+		switch tag {
+		case featExtHeader:
+			f.ExtHeader = true
+		case featMaxFrame:
+			if n == 4 {
+				f.MaxFrame = TByteOrder.Uint32(b[2:])
+			}
+		case featCompress:
+			if n == 1 {
+				f.Compress = b[2]
+			}
+		case featResume:
+			if n == len(f.Ticket) {
+				f.Resume = true
+				copy(f.Ticket[:], b[2:])
+			}
+		case featBond:
+			if n == len(f.Bond) {
+				copy(f.Bond[:], b[2:])
+			}
+		case featAddr:
+			f.Addr = true
+		case featDirect:
+			f.Direct = true
+		case featRekey:
+			f.Rekey = true
+		case featRejected:
+			f.Rejected = true
+		case featCipher:
+			f.hasCiphers, f.Ciphers = true, nil
+			if n > 0 {
+				f.Ciphers = strings.Split(string(b[2:2+n]), ",")
+			}
+		default:
+			// 不认识的扩展, 忽略
+		}
+		b = b[2+n:]
+	}
+	return f, true
+}
+
+/// 双方都支持的扩展. server用来决定最终使用的扩展.
+func (f Features) intersect(o Features) Features {
+	r := Features{
+		ExtHeader: f.ExtHeader && o.ExtHeader,
+		MaxFrame:  f.MaxFrame,
+		Compress:  f.Compress & o.Compress,
+		Resume:    f.ExtHeader && o.ExtHeader && f.Resume && o.Resume,
+		Addr:      f.Addr && o.Addr,
+		Direct:    f.Addr && o.Addr && f.Direct && o.Direct,
+		Rekey:     f.ExtHeader && o.ExtHeader && f.Rekey && o.Rekey,
+		Rejected:  f.Rejected && o.Rejected,
+	}
+	if o.hasCiphers { // 老版本的client没有提供列表, 使用本端的第一个
+		r.hasCiphers = true
+		if c := chooseCipher(f.Ciphers, o.Ciphers); c != "" {
+			r.Ciphers = []string{c}
+		}
+	}
+	if r.ExtHeader {
+		r.Bond = o.Bond // server总是支持捆绑, 使用client的组
+	}
+	if o.MaxFrame < r.MaxFrame {
+		r.MaxFrame = o.MaxFrame
+	}
+	return r
+}
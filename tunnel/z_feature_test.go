@@ -0,0 +1,50 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+/// 发送不带扩展的helloA, 返回server回复的challenge.
+func legacyHello(t *testing.T, s *Server, wg *sync.WaitGroup) ([]byte, error) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c2.Close() })
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.handleConn(c1, "127.0.0.1", nil)
+	}()
+	tun := newTunnel(c2)
+	helloA := newHelloA("secret")
+	if err := tun.WritePacket(0, helloA.toBytes(), FlushNow); err != nil {
+		t.Fatal(err)
+	}
+	_, helloB, err := tun.ReadPacket()
+	return helloB, err
+}
+
+/// 默认接受没有扩展的老版本peer, -strict时不回复challenge直接断开.
+func TestRequireFeatures(t *testing.T) {
+	ExitOnError = false
+	s, err := NewServer("127.0.0.1:0", "127.0.0.1:1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		s.Stop()
+		s.listener.Close()
+		wg.Wait()
+		RequireFeatures = false
+		ExitOnError = true
+	})
+
+	if helloB, err := legacyHello(t, s, &wg); err != nil || len(helloB) != TaaBlockSize {
+		t.Fatalf("legacy peer: challenge %d bytes, %v", len(helloB), err)
+	}
+	RequireFeatures = true
+	if helloB, err := legacyHello(t, s, &wg); err == nil {
+		t.Fatalf("strict: got challenge of %d bytes", len(helloB))
+	}
+}
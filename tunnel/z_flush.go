@@ -0,0 +1,59 @@
+package tunnel
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+/// WritePacket之后何时flush.
+type FlushMode uint8
+
+const (
+	FlushLazy FlushMode = iota // 合并发送, 最多延迟FlushDelay
+	FlushIdle                  // 没有其他写者在等待时立即flush, 否则合并
+	FlushNow                   // 立即flush, 用于握手和低延迟的映射
+)
+
+/// 有数据还没有flush时, 最多等待的时间. 0表示每次写入都立即flush.
+var FlushDelay = time.Millisecond * 20
+
+/// 写入之后决定是否flush, 调用者持有wlock.
+/// 空闲时立即发出, 交互式的小包不用等待; 有其他写者排队时由最后一个写者或者定时器flush, 批量数据得以合并.
+func (tun *Tunnel) flushAfterWrite(mode FlushMode) error {
+	switch {
+	case mode == FlushNow || FlushDelay <= 0 || atomic.LoadInt64(&tun.unflushed) >= tun.flushLimitSize():
+	case mode == FlushIdle && atomic.LoadInt32(&tun.waiting) == 0:
+	default:
+		tun.armFlush()
+		return nil
+	}
+	return tun.Flush()
+}
+
+/// 启动延迟flush的定时器, 调用者持有wlock.
+func (tun *Tunnel) armFlush() {
+	if tun.flushArmed {
+		return
+	}
+	tun.flushArmed = true
+	if tun.flushTimer == nil {
+		tun.flushTimer = time.AfterFunc(FlushDelay, tun.delayedFlush)
+	} else {
+		tun.flushTimer.Reset(FlushDelay)
+	}
+}
+
+func (tun *Tunnel) delayedFlush() {
+	var err error
+	tun.wlock.Lock()
+	tun.flushArmed = false
+	if tun.running && tun.werr == nil {
+		if err = tun.Flush(); err != nil {
+			tun.werr = err
+		}
+	}
+	tun.wlock.Unlock()
+	if err != nil { // Close需要wlock
+		tun.Close()
+	}
+}
@@ -0,0 +1,38 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+/// 统计底层连接的写入次数
+type countConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+/// 连续写入满帧时合并, 不会每一帧都flush.
+func TestFlushLazyFullFrames(t *testing.T) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	go io.Copy(io.Discard, c2)
+	cc := &countConn{Conn: c1}
+	tun := newTunnel(cc)
+
+	const n = 64
+	for i := 0; i < n; i++ {
+		if err := tun.WritePacket(1, mpool.Get(tun.maxFrame), FlushLazy); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w := atomic.LoadInt32(&cc.writes); w > n*3/4 {
+		t.Fatalf("%d writes for %d full frames", w, n)
+	}
+}
@@ -17,6 +17,9 @@ var format_stderr = logging.MustStringFormatter(
 var format_file = logging.MustStringFormatter(
 	`%{time:2006-01-02 15:04:05.000} %{level:.3s} %{message}`,
 )
+var format_syslog = logging.MustStringFormatter(
+	`%{level:.3s} %{message}`,
+)
 
 const (
 	LLError uint8 = iota
@@ -25,13 +28,26 @@ const (
 	LLDebug
 )
 
+/// 日志同时输出到stderr和w. w只记录warn以上级别, w为nil时只输出到stderr.
 func InitLogger(w io.Writer, pre uint16) {
 	preStr := fmt.Sprintf("%5d ", pre)
+	fmtStderr, fmtFile := format_stderr, format_file
+	if LogFormat == LogFormatJSON { // json每行一个对象,不加前缀.
+		preStr = ""
+		fmtStderr = &jsonFormatter{app: pre}
+		fmtFile = fmtStderr
+	}
+
 	backend_stderr := logging.NewLogBackend(os.Stderr, preStr, 0)
-	ft_stderr := logging.NewBackendFormatter(backend_stderr, format_stderr)
+	ft_stderr := logging.NewBackendFormatter(backend_stderr, fmtStderr)
+
+	if w == nil {
+		logging.SetBackend(ft_stderr)
+		return
+	}
 
 	backend_wfile := logging.NewLogBackend(w, preStr, 0)
-	ft_wfile := logging.NewBackendFormatter(backend_wfile, format_file)
+	ft_wfile := logging.NewBackendFormatter(backend_wfile, fmtFile)
 	wfile_leveled := logging.AddModuleLevel(ft_wfile)
 	wfile_leveled.SetLevel(logging.WARNING, "")
 
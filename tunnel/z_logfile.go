@@ -0,0 +1,195 @@
+package tunnel
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+/// RotateFile 是一个自动切分的日志文件, 实现io.Writer.
+/// 文件名为 Dir/Name<date>.log, 跨天或者超过MaxSize时切换到新文件.
+/// 旧文件按MaxBackups和MaxAge清理. Reopen用于配合logrotate.
+type RotateFile struct {
+	Dir        string
+	Name       string        // 文件名前缀
+	MaxSize    int64         // bytes, 0表示不按大小切分
+	MaxBackups int           // 保留的旧文件个数, 0表示不限制
+	MaxAge     time.Duration // 旧文件保留时间, 0表示不限制
+
+	mux  sync.Mutex
+	f    *os.File
+	day  string
+	size int64
+}
+
+func NewRotateFile(dir, name string, maxSize int64, maxBackups int, maxAge time.Duration) (*RotateFile, error) {
+	rf := &RotateFile{
+		Dir:        dir,
+		Name:       name,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+		MaxAge:     maxAge,
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	rf.cleanup(rf.Path()) // 经常重启的进程可能很少切换文件
+	return rf, nil
+}
+
+/// current file path
+func (rf *RotateFile) Path() string {
+	return filepath.Join(rf.Dir, rf.Name+rf.day+".log")
+}
+
+func (rf *RotateFile) open() error {
+	day := time.Now().Format("2006-01-02")
+	f, size, err := openLogFile(filepath.Join(rf.Dir, rf.Name+day+".log"))
+	if err != nil {
+		return err
+	}
+	rf.f, rf.day, rf.size = f, day, size
+	return nil
+}
+
+/// 以追加方式打开path, 返回已有的大小.
+func openLogFile(path string) (*os.File, int64, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (rf *RotateFile) Write(b []byte) (int, error) {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+
+	if rf.f == nil {
+		return 0, errClosed
+	}
+
+	switch {
+	case time.Now().Format("2006-01-02") != rf.day:
+		rf.rotate(false)
+	case rf.MaxSize > 0 && rf.size+int64(len(b)) > rf.MaxSize && rf.size > 0:
+		rf.rotate(true)
+	}
+	if rf.f == nil { // 切换失败, 也无法打开原来的文件
+		return 0, errClosed
+	}
+
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+/// 切换到新文件. bySize表示当天的文件已满, 需要先改名.
+/// 新文件打开之后才关闭旧文件, 打开失败时继续写旧文件, 不丢日志.
+func (rf *RotateFile) rotate(bySize bool) {
+	if bySize {
+		path := rf.Path()
+		backup := filepath.Join(rf.Dir, fmt.Sprintf("%s%s.%s.log", rf.Name, rf.day, time.Now().Format("150405.000")))
+		if os.Rename(path, backup) != nil { // windows不能改名打开的文件, 关闭之后再改名
+			rf.f.Close()
+			if err := os.Rename(path, backup); err != nil {
+				fmt.Fprintf(os.Stderr, "log rotate failed: %v\n", err)
+				backup = path
+			}
+			f, _, err := openLogFile(backup)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "log rotate failed: %v\n", err)
+				rf.f = nil
+				return
+			}
+			rf.f = f
+		}
+	}
+
+	old := rf.f
+	if err := rf.open(); err != nil {
+		fmt.Fprintf(os.Stderr, "log rotate failed: %v\n", err)
+		rf.day, rf.size = time.Now().Format("2006-01-02"), 0 // 当天或者写满MaxSize之前不再重试
+		return
+	}
+	old.Close()
+	go rf.cleanup(rf.Path())
+}
+
+/// 删除超出保留个数或者过期的旧文件.
+func (rf *RotateFile) cleanup(current string) {
+	if rf.MaxBackups <= 0 && rf.MaxAge <= 0 {
+		return
+	}
+
+	matches, err := filepath.Glob(filepath.Join(rf.Dir, rf.Name+"*.log"))
+	if err != nil {
+		return
+	}
+	// 只清理本文件切分出的文件: Name<date>.log 和 Name<date>.<time>.log
+	own := regexp.MustCompile(`^` + regexp.QuoteMeta(rf.Name) + `\d{4}-\d{2}-\d{2}(\.\d{6}\.\d{3})?\.log$`)
+
+	type backup struct {
+		path string
+		mod  time.Time
+	}
+	var backups []backup
+	for _, p := range matches {
+		if p == current || !own.MatchString(filepath.Base(p)) {
+			continue
+		}
+		if info, err := os.Stat(p); err == nil && !info.IsDir() {
+			backups = append(backups, backup{p, info.ModTime()})
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].mod.After(backups[j].mod) })
+
+	now := time.Now()
+	for i, b := range backups {
+		if (rf.MaxBackups > 0 && i >= rf.MaxBackups) || (rf.MaxAge > 0 && now.Sub(b.mod) > rf.MaxAge) {
+			os.Remove(b.path)
+		}
+	}
+}
+
+/// 重新打开日志文件. 收到SIGUSR1时调用, 配合logrotate的移动文件.
+/// 新文件打开失败时继续写原来的文件, 不丢日志.
+func (rf *RotateFile) Reopen() error {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+	old := rf.f
+	if err := rf.open(); err != nil {
+		fmt.Fprintf(os.Stderr, "log reopen failed: %v\n", err)
+		return err
+	}
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+func (rf *RotateFile) Close() error {
+	rf.mux.Lock()
+	defer rf.mux.Unlock()
+	if rf.f == nil {
+		return nil
+	}
+	err := rf.f.Close()
+	rf.f = nil
+	return err
+}
@@ -0,0 +1,37 @@
+package tunnel
+
+import (
+	"os"
+	"testing"
+)
+
+/// 跨天时新文件打开失败, 继续写原来的文件.
+func TestRotateKeepsOldFile(t *testing.T) {
+	dir := t.TempDir()
+	rf, err := NewRotateFile(dir, "gtwarn", 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	cur := rf.Path()
+	if err := os.Mkdir(cur+".d", 0755); err != nil {
+		t.Fatal(err)
+	}
+	// 当前文件改名为前一天的文件, 今天的文件名被目录占用
+	rf.day = "2000-01-01"
+	if err := os.Rename(cur, rf.Path()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(cur+".d", cur); err != nil {
+		t.Fatal(err)
+	}
+	old := rf.Path()
+
+	if _, err := rf.Write([]byte("still logging\n")); err != nil {
+		t.Fatalf("write after failed rotate: %v", err)
+	}
+	if info, err := os.Stat(old); err != nil || info.Size() == 0 {
+		t.Fatalf("old file not written: %v", err)
+	}
+}
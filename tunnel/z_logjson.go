@@ -0,0 +1,142 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+/// 结构化日志的字段名. 所有事件使用相同的key,方便在Loki/ES里按link查询.
+const (
+	FieldRole     = "role"     // client / server
+	FieldTun      = "tun"      // tunnel id
+	FieldLink     = "link"     // link id
+	FieldRemote   = "remote"   // remote addr
+	FieldUser     = "user"     // user name
+	FieldEvent    = "event"    // event name
+	FieldBytes    = "bytes"    // bytes
+	FieldDuration = "duration" // milliseconds
+	FieldReason   = "reason"   // close reason
+
+	FieldSide      = "side"       // local / remote / tunnel
+	FieldClient    = "client"     // client addr
+	FieldBackend   = "backend"    // backend addr
+	FieldStart     = "start"      // start time
+	FieldBytesUp   = "bytes_up"   // client -> backend
+	FieldBytesDown = "bytes_down" // backend -> client
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+/// 日志格式. text或者json(每行一个json对象).
+var LogFormat = LogFormatText
+
+/// 是否输出访问日志. 访问日志不受LogLevel限制.
+var AccessLog = true
+
+/// 结构化日志的字段.
+type LogFields map[string]interface{}
+
+/// text格式下的输出: k=v k=v, event放在最前面.
+func (f LogFields) String() string {
+	var keys []string
+	for k := range f {
+		if k != FieldEvent {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	if ev, ok := f[FieldEvent]; ok {
+		parts = append(parts, fmt.Sprint(ev))
+	}
+	for _, k := range keys {
+		parts = append(parts, k+"="+fmt.Sprint(f[k]))
+	}
+	return strings.Join(parts, " ")
+}
+
+/// 合并字段,返回新的LogFields. 后面的同名字段覆盖前面的.
+func (f LogFields) With(other LogFields) LogFields {
+	m := make(LogFields, len(f)+len(other))
+	for k, v := range f {
+		m[k] = v
+	}
+	for k, v := range other {
+		m[k] = v
+	}
+	return m
+}
+
+/// jsonFormatter 将一条日志输出为一行json.
+/// 普通的printf日志只有msg字段, 结构化日志展开全部字段.
+type jsonFormatter struct {
+	app uint16
+}
+
+func (jf *jsonFormatter) Format(calldepth int, r *logging.Record, w io.Writer) error {
+	m := LogFields{
+		"time":  r.Time.Format(time.RFC3339Nano),
+		"level": r.Level.String(),
+		"app":   jf.app,
+	}
+	if len(r.Args) == 1 {
+		if f, ok := r.Args[0].(LogFields); ok {
+			for k, v := range f {
+				if err, ok := v.(error); ok {
+					v = err.Error()
+				}
+				m[k] = v
+			}
+		} else {
+			m["msg"] = r.Message()
+		}
+	} else {
+		m["msg"] = r.Message()
+	}
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+func logEvent(level uint8, event string, f LogFields) {
+	if LogLevel < level {
+		return
+	}
+	f = f.With(LogFields{FieldEvent: event})
+	switch level {
+	case LLDebug:
+		log.Debug(f)
+	case LLInfo:
+		log.Info(f)
+	case LLWarn:
+		log.Warning(f)
+	default:
+		log.Error(f)
+	}
+}
+
+/// 访问日志, 每个link关闭时一条.
+func AccessEvent(f LogFields) {
+	if AccessLog {
+		log.Warning(f.With(LogFields{FieldEvent: "access"}))
+	}
+}
+
+/// 结构化日志. 与Debug/Info/Warn对应.
+func DebugEvent(event string, f LogFields) { logEvent(LLDebug, event, f) }
+func InfoEvent(event string, f LogFields)  { logEvent(LLInfo, event, f) }
+func WarnEvent(event string, f LogFields)  { logEvent(LLWarn, event, f) }
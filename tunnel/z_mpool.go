@@ -1,32 +1,45 @@
 package tunnel
 
 import (
+	"sort"
 	"sync"
 )
 
+/// 多个规格的内存池. Get返回容量不小于sz的最小规格,
+/// 小的交互数据不必占用一个最大帧的buffer.
 type MPool struct {
-	*sync.Pool
-	sz int
+	sizes []int
+	pools []*sync.Pool
 }
 
-func (p *MPool) Get() []byte {
+/// 超过最大规格的请求直接分配, 不回收, 也不计入T_Buf.
+func (p *MPool) Get(sz int) []byte {
+	i := sort.SearchInts(p.sizes, sz)
+	if i == len(p.sizes) {
+		return make([]byte, sz)
+	}
 	CT(T_Buf, OP_Increase)
-	return p.Pool.Get().([]byte)
+	return p.pools[i].Get().([]byte)[:sz]
 }
 
 func (p *MPool) Put(x []byte) {
-	if cap(x) == p.sz { //来自Pool的slice才可能回收.
-		p.Pool.Put(x[0:p.sz])
+	i := sort.SearchInts(p.sizes, cap(x))
+	if i < len(p.sizes) && p.sizes[i] == cap(x) { //来自Pool的slice才可能回收.
+		p.pools[i].Put(x[0:cap(x)])
 		CT(T_Buf, OP_Decrease)
 	}
 }
 
-func NewMPool(sz int) *MPool {
-	p := &MPool{sz: sz}
-	p.Pool = &sync.Pool{
-		New: func() interface{} {
-			return make([]byte, p.sz)
-		},
+func NewMPool(sizes ...int) *MPool {
+	p := &MPool{sizes: append([]int(nil), sizes...)}
+	sort.Ints(p.sizes)
+	for _, sz := range p.sizes {
+		sz := sz
+		p.pools = append(p.pools, &sync.Pool{
+			New: func() interface{} {
+				return make([]byte, sz)
+			},
+		})
 	}
 	return p
 }
@@ -0,0 +1,26 @@
+package tunnel
+
+import "testing"
+
+func ctValue(tt TType, op OP) uint64 {
+	ctMux.Lock()
+	defer ctMux.Unlock()
+	return CTmap[CTItem{tt, op}.String()]
+}
+
+/// 直接分配的buffer不回收, Get和Put的计数要配对.
+func TestMPoolCounter(t *testing.T) {
+	p := NewMPool(512, 8192)
+	outstanding := func() int64 {
+		return int64(ctValue(T_Buf, OP_Increase)) - int64(ctValue(T_Buf, OP_Decrease))
+	}
+	before := outstanding()
+	for _, sz := range []int{0, 100, 512, 513, 8192, 10000} {
+		for i := 0; i < 1000; i++ {
+			p.Put(p.Get(sz))
+		}
+		if d := outstanding() - before; d != 0 {
+			t.Fatalf("size %d: buffers outstanding changed by %d", sz, d)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package tunnel
+
+import (
+	"time"
+)
+
+/// 没有可用的hub时(启动时, 所有tunnel都在重连), 新连接先排队, 等第一个完成握手的hub.
+/// 超过PendingTimeout还没有hub, 或者队列已满时关闭连接.
+var (
+	PendingMax     = 128              // 排队连接数的上限
+	PendingTimeout = time.Second * 10 // 排队等待的时间, 0表示不排队, 没有hub时立即关闭
+)
+
+type pendingConn struct {
+	conn  halfConn
+	since time.Time
+	timer *time.Timer
+}
+
+/// 把连接交给hub, 没有hub时排队.
+func (cli *Client) dispatchConn(kconn halfConn) {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	if chub := cli.fetchHubLocked(kconn.RemoteAddr()); chub != nil {
+		cli.startLink(chub, kconn)
+		return
+	}
+	cli.demandLocked()
+	if PendingTimeout <= 0 || len(cli.pending) >= PendingMax {
+		WarnEvent("conn_dropped", LogFields{FieldRole: RoleClient, FieldRemote: addrString(kconn.RemoteAddr()),
+			FieldReason: "no active hub", "pending": len(cli.pending)})
+		kconn.Close()
+		return
+	}
+	p := &pendingConn{conn: kconn, since: time.Now()}
+	p.timer = time.AfterFunc(PendingTimeout, func() { cli.expirePending(p) })
+	cli.pending = append(cli.pending, p)
+	InfoEvent("conn_queued", LogFields{FieldRole: RoleClient, FieldRemote: addrString(kconn.RemoteAddr()),
+		"pending": len(cli.pending)})
+}
+
+/// 等待超时, 关闭连接.
+func (cli *Client) expirePending(p *pendingConn) {
+	cli.lock.Lock()
+	defer cli.lock.Unlock()
+	for i, q := range cli.pending {
+		if q == p {
+			cli.pending = append(cli.pending[:i], cli.pending[i+1:]...)
+			WarnEvent("conn_dropped", LogFields{FieldRole: RoleClient, FieldRemote: addrString(p.conn.RemoteAddr()),
+				FieldReason: "pending timeout", "pending": len(cli.pending)})
+			p.conn.Close()
+			return
+		}
+	}
+}
+
+/// 有hub加入之后, 把排队的连接交给hub. 调用者持有lock.
+func (cli *Client) flushPendingLocked() {
+	for len(cli.pending) > 0 {
+		p := cli.pending[0]
+		chub := cli.fetchHubLocked(p.conn.RemoteAddr())
+		if chub == nil {
+			return
+		}
+		cli.pending[0] = nil
+		cli.pending = cli.pending[1:]
+		p.timer.Stop()
+		InfoEvent("conn_dequeued", chub.fields(0).With(LogFields{FieldRemote: addrString(p.conn.RemoteAddr()),
+			"waited": time.Since(p.since)}))
+		cli.startLink(chub, p.conn)
+	}
+}
+
+func (cli *Client) startLink(chub *ClientHub, kconn halfConn) {
+	// 这是link对应的连接的时间设置
+	// 这不是TCP标准的一部分,并且不同的平台有不同的实现
+	// 而且设置的时间生效比较慢.
+	setKeepAlive(kconn, time.Second*30)
+	go cli.handleLinkConn(chub, kconn)
+}
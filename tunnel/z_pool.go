@@ -0,0 +1,164 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+/// 弹性的tunnel池.
+/// 始终保持MinTunnels个tunnel; 平均每个tunnel的link数或在途字节超过阈值时增加tunnel, 最多MaxTunnels个.
+/// 负载降低, 少一个tunnel也不超过阈值的一半, 并且持续PoolIdleTime时, 序号最大的额外tunnel不再分配link, 已有的link结束之后关闭.
+/// MinTunnels为0时按需连接: 启动时不建立tunnel, 第一个本地连接到来时才连接, 空闲之后全部关闭.
+var (
+	PoolCheckInterval = time.Second * 5  // 检查负载的间隔
+	PoolIdleTime      = time.Second * 60 // 负载持续降低这么久之后关闭额外的tunnel
+)
+
+/// tunnel池中的一个位置, 序号即hub的index.
+type poolSlot struct {
+	running bool
+	quit    chan struct{}
+}
+
+/// 位置已经在关闭
+func (s *poolSlot) quitting() bool {
+	select {
+	case <-s.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+/// 启动第index个位置的tunnel. 调用者持有lock, client已经Stop时不启动.
+func (cli *Client) startSlotLocked(index int) bool {
+	if cli.stoppedLocked() {
+		return false
+	}
+	s := &cli.slots[index]
+	s.running = true
+	s.quit = make(chan struct{})
+	cli.wg.Add(1)
+	go func() {
+		defer cli.wg.Done()
+		defer func() {
+			cli.lock.Lock()
+			s.running = false
+			if len(cli.pending) > 0 { // 关闭期间到来的连接在排队, 按需模式下没有其他位置会启动
+				cli.demandLocked()
+			}
+			cli.lock.Unlock()
+		}()
+		cli.runTunnel(index, s.quit)
+	}()
+	return true
+}
+
+/// 运行中的位置数
+func (cli *Client) runningLocked() (n int) {
+	for i := range cli.slots {
+		if cli.slots[i].running {
+			n++
+		}
+	}
+	return
+}
+
+/// 增加一个tunnel. 调用者持有lock.
+func (cli *Client) growLocked(reason string) bool {
+	for i := range cli.slots {
+		if !cli.slots[i].running {
+			if !cli.startSlotLocked(i) {
+				return false
+			}
+			InfoEvent("pool_grow", LogFields{FieldRole: RoleClient, "index": i, "tunnels": len(cli.hq), FieldReason: reason})
+			return true
+		}
+	}
+	return false
+}
+
+/// 减少一个额外的tunnel: 选序号最大的已连接的位置. 调用者持有lock.
+func (cli *Client) shrinkLocked() bool {
+	var victim *ClientHub
+	for _, h := range cli.hq {
+		if h.index >= int(cli.MinTunnels) && (victim == nil || h.index > victim.index) {
+			victim = h
+		}
+	}
+	if victim == nil {
+		return false
+	}
+	s := &cli.slots[victim.index]
+	if s.quitting() {
+		return false
+	}
+	InfoEvent("pool_shrink", victim.fields(0).With(LogFields{"index": victim.index, "tunnels": len(cli.hq)}))
+	close(s.quit)
+	return true
+}
+
+/// 定期检查负载, 调整tunnel数量.
+func (cli *Client) autoscale() {
+	defer Recover()
+	var lowSince time.Time
+	ticker := time.NewTicker(PoolCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-cli.quit:
+			return
+		case <-ticker.C:
+		}
+		cli.lock.Lock()
+		n := len(cli.hq)
+		links, inflight := 0, int64(0)
+		for _, h := range cli.hq {
+			links += h.Links()
+			inflight += h.InFlight()
+		}
+		running := cli.runningLocked()
+
+		// 所有位置都连接上之后才增加, 避免连接慢的时候一直增加
+		if n > 0 && running == n && running < int(cli.MaxTunnels) {
+			if cli.LinksPerTunnel > 0 && links >= cli.LinksPerTunnel*n {
+				cli.growLocked(fmt.Sprintf("links %d", links))
+			} else if cli.InFlightPerTunnel > 0 && inflight >= cli.InFlightPerTunnel*int64(n) {
+				cli.growLocked(fmt.Sprintf("inflight %d", inflight))
+			}
+		}
+
+		if n > int(cli.MinTunnels) && cli.underloadedLocked(n-1, links, inflight) {
+			if lowSince.IsZero() {
+				lowSince = time.Now()
+			} else if time.Since(lowSince) >= PoolIdleTime {
+				cli.shrinkLocked()
+				lowSince = time.Time{}
+			}
+		} else {
+			lowSince = time.Time{}
+		}
+		cli.lock.Unlock()
+	}
+}
+
+/// 用n个tunnel承担当前负载时, 是否还低于阈值的一半. 调用者持有lock.
+func (cli *Client) underloadedLocked(n, links int, inflight int64) bool {
+	if n == 0 {
+		return links == 0 && len(cli.pending) == 0
+	}
+	return (cli.LinksPerTunnel == 0 || links*2 < cli.LinksPerTunnel*n) &&
+		(cli.InFlightPerTunnel == 0 || inflight*2 < cli.InFlightPerTunnel*int64(n))
+}
+
+/// 按需连接: 没有tunnel时, 新连接触发第一个tunnel. 调用者持有lock.
+func (cli *Client) demandLocked() {
+	if cli.MinTunnels == 0 && cli.runningLocked() == 0 {
+		cli.growLocked("on demand")
+	}
+}
+
+func (cli *Client) poolStatus(w io.Writer) {
+	fmt.Fprintf(w, ", tunnels %d/%d..%d", len(cli.hq), cli.MinTunnels, cli.MaxTunnels)
+}
@@ -0,0 +1,269 @@
+package tunnel
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/// PROXY protocol.
+/// client在CD_LINK_CREATE之后附加本地连接的来源和目的地址(协商了featAddr时), server连接backend之后,
+/// 按backend的设置先写入PROXY protocol v1或v2的头, backend(nginx, HAProxy)就能看到真实的client地址.
+const (
+	ProxyNone = "none"
+	ProxyV1   = "v1"
+	ProxyV2   = "v2"
+)
+
+var ProxyProtocol = ProxyNone // backend没有单独设置时使用的版本
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+/// CD_LINK_CREATE附带的地址: family(1, 4或6) + src ip + dst ip + src port(2) + dst port(2), 与PROXY v2的地址块相同.
+/// family的最高位表示透明代理的link, server直接连接dst而不是backend.
+const linkAddrDirect = 0x80
+
+func encodeLinkAddrs(src, dst *net.TCPAddr) []byte {
+	family, sip, dip := addrFamily(src, dst)
+	if family == 0 {
+		return nil
+	}
+	b := append([]byte{family}, sip...)
+	b = append(b, dip...)
+	b = append(b, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	return b
+}
+
+/// 解析CD_LINK_CREATE附带的地址, 没有或者格式错误时返回nil.
+func parseLinkAddrs(b []byte) (src, dst *net.TCPAddr, direct bool) {
+	if len(b) < 1 {
+		return
+	}
+	n := 4
+	switch b[0] &^ linkAddrDirect {
+	case 4:
+	case 6:
+		n = 16
+	default:
+		return
+	}
+	if len(b) != 1+2*n+4 {
+		return
+	}
+	direct = b[0]&linkAddrDirect != 0
+	b = b[1:]
+	src = &net.TCPAddr{IP: append(net.IP(nil), b[:n]...), Port: int(binary.BigEndian.Uint16(b[2*n:]))}
+	dst = &net.TCPAddr{IP: append(net.IP(nil), b[n:2*n]...), Port: int(binary.BigEndian.Uint16(b[2*n+2:]))}
+	return
+}
+
+/// 两个地址都是IPv4时返回4, 否则都转为IPv6的形式. 地址无效时返回0.
+func addrFamily(src, dst *net.TCPAddr) (family byte, sip, dip net.IP) {
+	if src == nil || dst == nil {
+		return
+	}
+	if s4, d4 := src.IP.To4(), dst.IP.To4(); s4 != nil && d4 != nil {
+		return 4, s4, d4
+	}
+	if s16, d16 := src.IP.To16(), dst.IP.To16(); s16 != nil && d16 != nil {
+		return 6, s16, d16
+	}
+	return
+}
+
+/// 写入PROXY protocol的头. 没有地址时v1写UNKNOWN, v2使用LOCAL命令, backend按连接本身的地址处理.
+func writeProxyHeader(w io.Writer, version string, src, dst *net.TCPAddr) error {
+	family, sip, dip := addrFamily(src, dst)
+	var buf bytes.Buffer
+	switch version {
+	case ProxyV1:
+		switch family {
+		case 4:
+			fmt.Fprintf(&buf, "PROXY TCP4 %s %s %d %d\r\n", sip, dip, src.Port, dst.Port)
+		case 6:
+			fmt.Fprintf(&buf, "PROXY TCP6 %s %s %d %d\r\n", sip, dip, src.Port, dst.Port)
+		default:
+			buf.WriteString("PROXY UNKNOWN\r\n")
+		}
+	case ProxyV2:
+		buf.Write(proxyV2Sig)
+		addrs := encodeLinkAddrs(src, dst)
+		switch family {
+		case 4:
+			buf.Write([]byte{0x21, 0x11}) // v2 PROXY, TCP over IPv4
+		case 6:
+			buf.Write([]byte{0x21, 0x21}) // v2 PROXY, TCP over IPv6
+		default:
+			buf.Write([]byte{0x20, 0x00}) // v2 LOCAL, UNSPEC
+			addrs = []byte{0}
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(len(addrs)-1))
+		buf.Write(addrs[1:])
+	default:
+		return nil
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+/// 是否是支持的PROXY protocol版本
+func ValidProxy(version string) bool {
+	return version == ProxyNone || version == ProxyV1 || version == ProxyV2
+}
+
+/// server的tunnel监听在L4负载均衡之后时, 从PROXY protocol的头取得真实的client地址, 用于日志, 状态和准入限制.
+/// 只解析来自TrustedProxies的连接, 其他来源按普通连接处理. 来自信任来源的连接必须带有头.
+/// 任何来源都可以用头伪造地址, 绕过准入限制, 所以AcceptProxy必须同时设置TrustedProxies.
+var (
+	AcceptProxy        bool
+	TrustedProxies     []*net.IPNet    // 空表示不信任任何来源
+	ProxyHeaderTimeout = time.Second * 5 // 读取头的超时
+)
+
+/// 替换了对端地址的连接
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+/// 解析逗号分隔的CIDR列表, 单个IP按/32或/128处理.
+func ParseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("bad ip %s", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+var ErrNoTrustedProxies = errors.New("accepting PROXY protocol needs trusted proxies")
+
+func trustedProxy(addr net.Addr) bool {
+	return ipInNets(TrustedProxies, net.ParseIP(addrIP(addr)))
+}
+
+func ipInNets(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/// 来自信任来源的连接读取PROXY protocol的头, 返回使用真实地址的连接.
+func acceptProxy(conn net.Conn) (net.Conn, error) {
+	if !AcceptProxy || !trustedProxy(conn.RemoteAddr()) {
+		return conn, nil
+	}
+	conn.SetReadDeadline(time.Now().Add(ProxyHeaderTimeout))
+	src, err := readProxyHeader(conn)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	if src == nil { // LOCAL, UNKNOWN: 负载均衡自己的连接, 比如健康检查
+		return conn, nil
+	}
+	return &proxiedConn{conn, src}, nil
+}
+
+/// 读取v1或v2的头. 逐字节读取v1, 不会读到头之后的数据.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if bytes.Equal(head, proxyV2Sig[:8]) {
+		return readProxyV2(r)
+	}
+	if string(head[:6]) != "PROXY " {
+		return nil, fmt.Errorf("no proxy header")
+	}
+	line := head
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= 107 { // v1的最大长度
+			return nil, fmt.Errorf("proxy v1 header too long")
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+	f := strings.Fields(string(line))
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, fmt.Errorf("bad proxy v1 header %q", line)
+	}
+	ip := net.ParseIP(f[2])
+	port, err := strconv.Atoi(f[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("bad proxy v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	head := make([]byte, 8) // sig的后4字节 + ver_cmd + fam + len
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head[:4], proxyV2Sig[8:]) || head[4]>>4 != 2 {
+		return nil, fmt.Errorf("bad proxy v2 header")
+	}
+	n := int(binary.BigEndian.Uint16(head[6:]))
+	if n > 4096 {
+		return nil, fmt.Errorf("proxy v2 header too long")
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if head[4]&0xf == 0 || head[5]&0xf != 1 { // LOCAL, 或者不是TCP
+		return nil, nil
+	}
+	switch head[5] >> 4 {
+	case 1:
+		if n >= 12 {
+			return &net.TCPAddr{IP: net.IP(body[:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}, nil
+		}
+	case 2:
+		if n >= 36 {
+			return &net.TCPAddr{IP: net.IP(body[:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}, nil
+		}
+	default:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("short proxy v2 address")
+}
@@ -0,0 +1,134 @@
+package tunnel
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+/// server端的准入限制, 0表示不限制.
+type Quotas struct {
+	TunnelsPerIP   int   // 每个来源IP的tunnel数
+	TunnelsPerUser int   // 每个用户的tunnel数
+	LinksPerHub    int   // 每个tunnel的并发link数
+	Links          int   // 全局并发link数
+	LinkRate       int64 // 每秒新建link数
+}
+
+var (
+	quotaMux    sync.Mutex
+	quotas      Quotas
+	linkRateCfg int64
+	// 新建link的速率限制, 令牌即link个数.
+	linkCreateLimiter = newRateLimiter(&linkRateCfg)
+
+	activeLinks int64 // server端的并发link数
+)
+
+func SetQuotas(q Quotas) {
+	quotaMux.Lock()
+	defer quotaMux.Unlock()
+	quotas = q
+	atomic.StoreInt64(&linkRateCfg, q.LinkRate)
+}
+
+func GetQuotas() Quotas {
+	quotaMux.Lock()
+	defer quotaMux.Unlock()
+	return quotas
+}
+
+/// 统计每个IP, 每个用户的tunnel数.
+type tunnelCounter struct {
+	mux    sync.Mutex
+	byIP   map[string]int
+	byUser map[string]int
+}
+
+func newTunnelCounter() *tunnelCounter {
+	return &tunnelCounter{
+		byIP:   make(map[string]int),
+		byUser: make(map[string]int),
+	}
+}
+
+func addrIP(addr net.Addr) string {
+	return hostOf(addr.String())
+}
+
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+/// 占用一个IP的名额, 超出限制时返回error.
+func (tc *tunnelCounter) acquireIP(ip string) error {
+	q := GetQuotas()
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	if q.TunnelsPerIP > 0 && tc.byIP[ip] >= q.TunnelsPerIP {
+		return fmt.Errorf("too many tunnels from %s", ip)
+	}
+	tc.byIP[ip]++
+	return nil
+}
+
+func (tc *tunnelCounter) releaseIP(ip string) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	if tc.byIP[ip]--; tc.byIP[ip] <= 0 {
+		delete(tc.byIP, ip)
+	}
+}
+
+/// 占用一个用户的名额, 超出限制时返回error.
+func (tc *tunnelCounter) acquireUser(user string) error {
+	q := GetQuotas()
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	if q.TunnelsPerUser > 0 && tc.byUser[user] >= q.TunnelsPerUser {
+		return fmt.Errorf("too many tunnels of user %s", user)
+	}
+	tc.byUser[user]++
+	return nil
+}
+
+func (tc *tunnelCounter) releaseUser(user string) {
+	tc.mux.Lock()
+	defer tc.mux.Unlock()
+	if tc.byUser[user]--; tc.byUser[user] <= 0 {
+		delete(tc.byUser, user)
+	}
+}
+
+/// 新建link的准入检查. 通过时占用一个全局名额, link结束后调用releaseLink.
+func (h *Hub) admitLink() error {
+	return admitLink(h.linkCount())
+}
+
+/// 已经有n个link时的准入检查
+func admitLink(n int) error {
+	q := GetQuotas()
+
+	if q.LinksPerHub > 0 && n >= q.LinksPerHub {
+		return fmt.Errorf("too many links in tunnel(%d)", n)
+	}
+
+	if !linkCreateLimiter.Allow(1) {
+		return fmt.Errorf("link create rate exceeded")
+	}
+
+	if total := atomic.AddInt64(&activeLinks, 1); q.Links > 0 && total > int64(q.Links) {
+		atomic.AddInt64(&activeLinks, -1)
+		return fmt.Errorf("too many links(%d)", total-1)
+	}
+	return nil
+}
+
+func releaseLink() {
+	atomic.AddInt64(&activeLinks, -1)
+}
@@ -0,0 +1,45 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+/// 超出准入限制的CREATE收到的关闭命令: 协商了featRejected时是CD_LINK_CLOSE_Rejected, 老版本的client是CD_LINK_CLOSE.
+func TestRejectCode(t *testing.T) {
+	SetQuotas(Quotas{LinksPerHub: 1})
+	defer SetQuotas(Quotas{})
+	for _, rejected := range []bool{true, false} {
+		c1, c2 := net.Pipe()
+		sh := newServerHub(newTunnel(c1), nil)
+		sh.rejected = rejected
+		sh.links[1] = newLink(1, 1024)
+		go sh.onCtrl(Ctrl{CD_LINK_CREATE, 2}, nil)
+
+		peer := newHub(newTunnel(c2), RoleClient)
+		_, data, err := peer.tunnel.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd, err := peer.parseCtrl(data)
+		want := uint8(CD_LINK_CLOSE)
+		if rejected {
+			want = CD_LINK_CLOSE_Rejected
+		}
+		if err != nil || cmd.LinkId != 2 || cmd.Code != want {
+			t.Errorf("rejected %v: got %v %v, want %s", rejected, cmd, err, ctrlName(want))
+		}
+		c1.Close()
+		c2.Close()
+	}
+}
+
+func TestFeatureRejected(t *testing.T) {
+	f, ok := parseFeatures(localFeatures().toBytes())
+	if !ok || !f.Rejected {
+		t.Fatalf("local features: %+v %v", f, ok)
+	}
+	if localFeatures().intersect(Features{ExtHeader: true}).Rejected {
+		t.Fatal("Rejected negotiated with a client without it")
+	}
+}
@@ -0,0 +1,253 @@
+package tunnel
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/// 令牌桶限速, 单位 bytes/s. 最多积累1秒的令牌.
+/// rate指向共享的配置, 修改配置后所有使用它的限速器立即生效. rate为0表示不限速.
+type RateLimiter struct {
+	rate   *int64
+	mux    sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate *int64) *RateLimiter {
+	return &RateLimiter{rate: rate}
+}
+
+func NewRateLimiter(rate int64) *RateLimiter {
+	return newRateLimiter(&rate)
+}
+
+func (l *RateLimiter) Rate() int64 {
+	return atomic.LoadInt64(l.rate)
+}
+
+func (l *RateLimiter) SetRate(rate int64) {
+	atomic.StoreInt64(l.rate, rate)
+}
+
+/// 取走n个令牌, 令牌不足时阻塞. nil表示不限速.
+func (l *RateLimiter) Wait(n int) {
+	if l == nil {
+		return
+	}
+	rate := float64(l.Rate())
+	if rate <= 0 {
+		return
+	}
+
+	l.mux.Lock()
+	l.refill(rate)
+	l.tokens -= float64(n) // 允许透支, 由后面的sleep偿还
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / rate * float64(time.Second))
+	}
+	l.mux.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+/// 取走n个令牌, 不等待. 透支的令牌由之后的Wait偿还, 最多透支1秒的令牌. nil表示不限速.
+func (l *RateLimiter) Charge(n int) {
+	if l == nil {
+		return
+	}
+	rate := float64(l.Rate())
+	if rate <= 0 {
+		return
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.refill(rate)
+	if l.tokens -= float64(n); l.tokens < -rate {
+		l.tokens = -rate
+	}
+}
+
+/// 非阻塞. 令牌足够时取走n个令牌并返回true. nil表示不限速.
+func (l *RateLimiter) Allow(n int) bool {
+	if l == nil {
+		return true
+	}
+	rate := float64(l.Rate())
+	if rate <= 0 {
+		return true
+	}
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.refill(rate)
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+func (l *RateLimiter) refill(rate float64) {
+	now := time.Now()
+	if l.last.IsZero() {
+		l.tokens = rate
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * rate
+	}
+	if l.tokens > rate {
+		l.tokens = rate
+	}
+	l.last = now
+}
+
+/// 限速配置, 单位 bytes/s, 0表示不限速.
+/// Global限制整个进程, Tunnel和Link分别限制每个tunnel和每个link, User按用户限制.
+type RateLimits struct {
+	Global int64
+	Tunnel int64
+	Link   int64
+	User   map[string]int64
+}
+
+var (
+	globalRate, tunnelRate, linkRate int64
+
+	globalLimiter = newRateLimiter(&globalRate)
+
+	userLimitMux sync.Mutex
+	userLimiters = make(map[string]*RateLimiter)
+)
+
+/// 修改限速配置, 运行中的tunnel和link立即生效.
+func SetRateLimits(rl RateLimits) {
+	atomic.StoreInt64(&globalRate, rl.Global)
+	atomic.StoreInt64(&tunnelRate, rl.Tunnel)
+	atomic.StoreInt64(&linkRate, rl.Link)
+
+	userLimitMux.Lock()
+	defer userLimitMux.Unlock()
+	for user, l := range userLimiters {
+		if _, ok := rl.User[user]; !ok {
+			l.SetRate(0)
+		}
+	}
+	for user, rate := range rl.User {
+		if l, ok := userLimiters[user]; ok {
+			l.SetRate(rate)
+		} else {
+			userLimiters[user] = NewRateLimiter(rate)
+		}
+	}
+}
+
+func GetRateLimits() RateLimits {
+	rl := RateLimits{
+		Global: atomic.LoadInt64(&globalRate),
+		Tunnel: atomic.LoadInt64(&tunnelRate),
+		Link:   atomic.LoadInt64(&linkRate),
+		User:   make(map[string]int64),
+	}
+	userLimitMux.Lock()
+	defer userLimitMux.Unlock()
+	for user, l := range userLimiters {
+		if rate := l.Rate(); rate > 0 {
+			rl.User[user] = rate
+		}
+	}
+	return rl
+}
+
+/// 用户的限速器, 没有配置时创建一个不限速的, 之后的SetRateLimits可以修改它.
+/// hub建立时取一次, 每个packet不用获取userLimitMux.
+func userLimiter(user string) *RateLimiter {
+	userLimitMux.Lock()
+	defer userLimitMux.Unlock()
+	l := userLimiters[user]
+	if l == nil {
+		l = NewRateLimiter(0)
+		userLimiters[user] = l
+	}
+	return l
+}
+
+/// 解析速率, 支持K/M/G后缀(1024进制), 例如 512K, 10M.
+func ParseRate(s string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(s))
+	mul := int64(1)
+	switch {
+	case strings.HasSuffix(v, "K"):
+		mul = 1 << 10
+	case strings.HasSuffix(v, "M"):
+		mul = 1 << 20
+	case strings.HasSuffix(v, "G"):
+		mul = 1 << 30
+	}
+	if mul > 1 {
+		v = v[:len(v)-1]
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad rate: %q", s)
+	}
+	return n * mul, nil
+}
+
+/// 从文件读取限速配置. 每行一项, #开头为注释:
+///   global 100M
+///   tunnel 10M
+///   link 2M
+///   user default 20M
+func LoadRateLimits(path string) (RateLimits, error) {
+	rl := RateLimits{User: make(map[string]int64)}
+	f, err := os.Open(path)
+	if err != nil {
+		return rl, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var rate int64
+		switch {
+		case len(fields) == 2 && fields[0] != "user":
+			rate, err = ParseRate(fields[1])
+		case len(fields) == 3 && fields[0] == "user":
+			rate, err = ParseRate(fields[2])
+		default:
+			err = fmt.Errorf("bad line")
+		}
+		if err != nil {
+			return rl, fmt.Errorf("%s:%d: %v", path, lineNo, err)
+		}
+
+		switch fields[0] {
+		case "global":
+			rl.Global = rate
+		case "tunnel":
+			rl.Tunnel = rate
+		case "link":
+			rl.Link = rate
+		case "user":
+			rl.User[fields[1]] = rate
+		default:
+			return rl, fmt.Errorf("%s:%d: unknown item %s", path, lineNo, fields[0])
+		}
+	}
+	return rl, scanner.Err()
+}
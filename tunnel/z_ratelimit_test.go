@@ -0,0 +1,89 @@
+package tunnel
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+/// 只有本端设置了linkrate, 对端按全速发送: 写入kconn时按本端的限速等待.
+func TestLinkRateInbound(t *testing.T) {
+	SetRateLimits(RateLimits{Link: 16 << 10})
+	defer SetRateLimits(RateLimits{})
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	go io.Copy(io.Discard, c2)
+	h := newHub(newTunnel(c1), RoleServer)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	local, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := newLink(1, 1024)
+	go h.runLink(k, conn.(*net.TCPConn))
+
+	h.links[k.id] = k
+	const n = 48 << 10 // 1秒的令牌之后, 剩下的32K按16K/s需要2秒
+	go func() {
+		for i := 0; i < n/1024; i++ {
+			h.onData(k.id, mpool.Get(1024)) // 没有bond时交给link
+		}
+	}()
+	start := time.Now()
+	local.SetReadDeadline(start.Add(10 * time.Second))
+	if m, err := io.ReadFull(local, make([]byte, n)); err != nil {
+		t.Fatalf("read %d of %d: %v", m, n, err)
+	}
+	if d := time.Since(start); d < 1500*time.Millisecond {
+		t.Fatalf("%d bytes delivered in %v, link rate not enforced", n, d)
+	}
+}
+
+func TestRateLimiterCharge(t *testing.T) {
+	l := NewRateLimiter(1 << 20)
+	start := time.Now()
+	l.Charge(10 << 20) // 最多透支1秒
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("charge waited %v", d)
+	}
+	start = time.Now()
+	l.Wait(1)
+	if d := time.Since(start); d < 800*time.Millisecond || d > 2*time.Second {
+		t.Fatalf("expect about 1s to repay, waited %v", d)
+	}
+}
+
+/// hub建立时取得用户的限速器, 之后修改配置也对它生效; 同一个用户的hub共用一个.
+func TestUserLimiterResolvedOnce(t *testing.T) {
+	defer SetRateLimits(RateLimits{})
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	h1, h2 := newHub(newTunnel(c1), RoleServer), newHub(newTunnel(c2), RoleServer)
+	h1.setUser("carol")
+	h2.setUser("carol")
+	if h1.uLimiter != h2.uLimiter {
+		t.Fatal("hubs of one user have different limiters")
+	}
+	SetRateLimits(RateLimits{User: map[string]int64{"carol": 1 << 10}})
+	if h1.uLimiter.Rate() != 1<<10 {
+		t.Fatalf("rate %d after SetRateLimits", h1.uLimiter.Rate())
+	}
+	SetRateLimits(RateLimits{})
+	if h1.uLimiter.Rate() != 0 {
+		t.Fatalf("rate %d after removing the limit", h1.uLimiter.Rate())
+	}
+}
@@ -0,0 +1,87 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+/// 换密钥.
+/// tunnel的每个方向写入RekeyBytes字节或者经过RekeyInterval之后, 写入方发送CD_REKEY, 然后换用新的密钥.
+/// CD_REKEY附带新密钥开始使用的packet id, 即它之后的下一个packet. 接收方在ReadPacket中处理,
+/// 读下一个packet之前换用新的密钥, 所以两端在同一个packet边界切换, 不影响link.
+/// 新密钥由当前密钥派生, 两个方向各自独立. 会话恢复之后使用新连接握手的密钥.
+var (
+	RekeyBytes    int64 = 1 << 30   // 0表示不按字节数换密钥
+	RekeyInterval       = time.Hour // 0表示不按时间换密钥
+)
+
+var errRekey = errors.New("error PacketId in CD_REKEY")
+
+/// CD_REKEY, 只在协商了featRekey(需要HeaderExt)时使用
+type CtrlRekey struct {
+	Code     uint8
+	LinkId   uint32
+	PacketId uint16 // 从这个packet开始使用新的密钥
+}
+
+/// 由当前密钥派生下一个密钥
+func nextKey(key [32]byte) [32]byte {
+	return sha256.Sum256(append(key[:], "dktunnel-rekey"...))
+}
+
+func (tn *tnConn) rekey(write bool) {
+	if write {
+		tn.setEncKey(nextKey(tn.encKey))
+	} else {
+		tn.setDecKey(nextKey(tn.decKey))
+	}
+}
+
+/// 写入一个packet之后检查是否需要换密钥. 调用者持有wlock
+func (tun *Tunnel) rekeyLocked() error {
+	if !tun.rekey {
+		return nil
+	}
+	if (RekeyBytes <= 0 || tun.rekeyBytes < RekeyBytes) &&
+		(RekeyInterval <= 0 || time.Since(tun.rekeyTime) < RekeyInterval) {
+		return nil
+	}
+	buf := bytes.NewBuffer(mpool.Get(0))
+	defer mpool.Put(buf.Bytes())
+	binary.Write(buf, TByteOrder, &CtrlRekey{CD_REKEY, 0, tun.writePacketIdCounter + 1})
+	if err := tun.writeFrameLocked(0, buf.Bytes(), 0); err != nil {
+		return err
+	}
+	tun.tconn.rekey(true)
+	atomic.AddInt32(&tun.rekeys, 1)
+	Info("%s rekey after %d bytes", tun, tun.rekeyBytes)
+	tun.rekeyBytes, tun.rekeyTime = 0, time.Now()
+	return nil
+}
+
+func (tun *Tunnel) isRekeyPacket(linkId uint32, data []byte) bool {
+	return tun.rekey && linkId == 0 && len(data) == binary.Size(CtrlRekey{}) && data[0] == CD_REKEY
+}
+
+/// 读goroutine收到CD_REKEY
+func (tun *Tunnel) onRekey(data []byte) error {
+	var cmd CtrlRekey
+	binary.Read(bytes.NewBuffer(data), TByteOrder, &cmd)
+	if cmd.PacketId != tun.readPacketIdCounter {
+		Error("%s bad CD_REKEY packet id %d, expect %d", tun, cmd.PacketId, tun.readPacketIdCounter)
+		return errRekey
+	}
+	tun.tconn.rekey(false)
+	atomic.AddInt32(&tun.rekeys, 1)
+	Debug("%s peer rekeyed", tun)
+	return nil
+}
+
+/// 两个方向换密钥的次数
+func (tun *Tunnel) Rekeys() int {
+	return int(atomic.LoadInt32(&tun.rekeys))
+}
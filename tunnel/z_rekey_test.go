@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"net"
+	"sync"
+	"testing"
+)
+
+/// 一对握手之后的tunnel, 协商了换密钥.
+func rekeyPair(t *testing.T) (cli, srv *Tunnel) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close(); s.Close() })
+
+	token := AuthToken{Challenge: 1, Timestamp: 2}
+	f := Features{ExtHeader: true, Rekey: true}
+	cli, srv = newTunnel(c), newTunnel(s)
+	cli.tconn.setKeys(token, "secret", "AES-256-CTR", true)
+	srv.tconn.setKeys(token, "secret", "AES-256-CTR", false)
+	cli.setFeatures(f)
+	srv.setFeatures(f)
+	return
+}
+
+func rekeyPacket(w, i int) []byte {
+	data := mpool.Get(1 + (w*7919+i*104729)%3000)
+	for j := range data {
+		data[j] = byte(w*31 + i + j)
+	}
+	return data
+}
+
+/// 每个写goroutine用自己的link id, 顺序写入count个packet.
+func rekeyWrite(t *testing.T, tun *Tunnel, writers, count int, wg *sync.WaitGroup) {
+	for w := 1; w <= writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				flush := FlushIdle
+				if i == count-1 {
+					flush = FlushNow
+				}
+				if err := tun.WritePacket(uint32(w), rekeyPacket(w, i), flush); err != nil {
+					t.Errorf("write %d/%d: %v", w, i, err)
+					return
+				}
+			}
+		}(w)
+	}
+}
+
+/// 读出所有packet, 按link检查顺序和内容. 读到CD_REKEY时ReadPacket自己处理, 不会返回.
+func rekeyRead(t *testing.T, tun *Tunnel, writers, count int, wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		next := make([]int, writers+1)
+		for n := 0; n < writers*count; n++ {
+			kid, data, err := tun.ReadPacket()
+			if err != nil {
+				t.Errorf("read after %d packets: %v", n, err)
+				return
+			}
+			if kid == 0 || int(kid) > writers {
+				t.Errorf("unexpected link %d", kid)
+				return
+			}
+			want := rekeyPacket(int(kid), next[kid])
+			if string(data) != string(want) {
+				t.Errorf("link %d packet %d corrupted", kid, next[kid])
+				return
+			}
+			next[kid]++
+			mpool.Put(data)
+			mpool.Put(want)
+		}
+	}()
+}
+
+/// 每写入几K字节就换一次密钥, 两个方向同时有多个goroutine并发写入, 数据不能出错.
+func TestRekeyConcurrentWrites(t *testing.T) {
+	old := RekeyBytes
+	RekeyBytes = 4 << 10
+	defer func() { RekeyBytes = old }()
+
+	cli, srv := rekeyPair(t)
+	const writers, count = 4, 300
+	var wg sync.WaitGroup
+	rekeyRead(t, cli, writers, count, &wg)
+	rekeyRead(t, srv, writers, count, &wg)
+	rekeyWrite(t, cli, writers, count, &wg)
+	rekeyWrite(t, srv, writers, count, &wg)
+	wg.Wait()
+
+	// 每个方向大约写入writers*count*1500字节, 写入方和接收方各计一次
+	min := writers * count * 1500 / int(RekeyBytes) / 2
+	if cli.Rekeys() < 2*min || cli.Rekeys() != srv.Rekeys() {
+		t.Fatalf("rekeys: client %d, server %d, want equal and at least %d", cli.Rekeys(), srv.Rekeys(), 2*min)
+	}
+}
@@ -14,6 +14,7 @@ func Report(app APP) {
 		app.Status(&b)
 		Warn("status: %s", b.String())
 		Warn("%s", CTtoString())
+		Warn("traffic: %s, %s", TotalStats.Snapshot(), TotalCompress.Snapshot())
 	}
 }
 
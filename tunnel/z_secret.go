@@ -0,0 +1,107 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+/// secret可以来自文件, 环境变量或者stdin, 不出现在命令行里.
+/// 每行一个secret, 忽略空行和#开头的行. 第一个是本端使用的secret;
+/// 轮换期间server同时接受其余的secret, 按helloA中的hash判断client使用的是哪一个.
+/// 一行可以写成 "user 名字 secret", 指定使用这个secret的用户, 用于按用户限速, 限制tunnel数和日志.
+/// 同一个用户可以有多个secret(轮换期间), 没有指定用户的secret属于DefaultUser.
+
+/// 解析多行的secret
+func ParseSecrets(s string) []string {
+	var l []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		l = append(l, line)
+	}
+	return l
+}
+
+/// 分开secret行中的用户名和secret
+func SplitSecret(line string) (user, secret string) {
+	if rest := strings.TrimPrefix(line, "user "); rest != line {
+		if f := strings.Fields(rest); len(f) >= 2 {
+			return f[0], strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(rest), f[0]))
+		}
+	}
+	return DefaultUser, line
+}
+
+/// 从文件读取secret. 文件不能被其他用户读写. path为-时从stdin读取, stdin是终端时先输出提示, 输入不回显.
+func LoadSecrets(path string) ([]string, error) {
+	var data []byte
+	if path == "-" {
+		if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) { // 不回显输入的secret
+			fmt.Fprint(os.Stderr, "secret: ")
+			line, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return nil, err
+			}
+			data = line
+		} else {
+			var err error
+			if data, err = io.ReadAll(os.Stdin); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		if runtime.GOOS != "windows" && fi.Mode().Perm()&0077 != 0 {
+			return nil, fmt.Errorf("secret file %s is accessible by other users (mode %o), chmod 600 it", path, fi.Mode().Perm())
+		}
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	l := ParseSecrets(string(data))
+	if len(l) == 0 {
+		return nil, fmt.Errorf("no secret in %s", path)
+	}
+	return l, nil
+}
+
+/// helloA中的hash, server用它找到client使用的secret
+func helloHash(secret string, now uint64, salt [32]byte) [32]byte {
+	str := secret + "," + fmt.Sprintf("%d", now) + "," + hex.EncodeToString(salt[:])
+	return sha256.Sum256([]byte(str))
+}
+
+/// server接受的所有secret行
+func (s *Server) secrets() []string {
+	return append([]string{s.secret}, s.ExtraSecrets...)
+}
+
+/// 按helloA找到client使用的secret和它的用户. 没有匹配的secret时使用第一个, 认证会失败.
+func (s *Server) matchSecret(helloA []byte) (user, secret string) {
+	var a HelloA
+	if len(s.ExtraSecrets) == 0 || len(helloA) < binary.Size(a) {
+		return SplitSecret(s.secret)
+	}
+	binary.Read(bytes.NewReader(helloA), TByteOrder, &a)
+	for _, line := range s.secrets() {
+		if user, secret = SplitSecret(line); helloHash(secret, a.Now, a.Salt) == a.Hash {
+			return
+		}
+	}
+	return SplitSecret(s.secret)
+}
@@ -0,0 +1,157 @@
+package tunnel
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+/// client为新连接选择hub的策略. hubs不为空, src是本地连接的来源地址.
+/// 调用时持有Client的锁, 实现不能阻塞.
+type HubSelector interface {
+	Select(hubs []*ClientHub, src net.Addr) *ClientHub
+}
+
+/// link最少
+type leastLinks struct{}
+
+func (leastLinks) Select(hubs []*ClientHub, src net.Addr) *ClientHub {
+	best := hubs[0]
+	for _, h := range hubs[1:] {
+		if h.Links() < best.Links() {
+			best = h
+		}
+	}
+	return best
+}
+
+/// 心跳测得的RTT最小. 还没有测到RTT的hub优先, 让它尽快有数据; RTT相同时选link少的.
+type lowestRTT struct{}
+
+func (lowestRTT) Select(hubs []*ClientHub, src net.Addr) *ClientHub {
+	best := hubs[0]
+	for _, h := range hubs[1:] {
+		r, br := h.RTT(), best.RTT()
+		if r < br || (r == br && h.Links() < best.Links()) {
+			best = h
+		}
+	}
+	return best
+}
+
+/// 在途字节最少, 见ClientHub.InFlight
+type leastInFlight struct{}
+
+func (leastInFlight) Select(hubs []*ClientHub, src net.Addr) *ClientHub {
+	best := hubs[0]
+	for _, h := range hubs[1:] {
+		if h.InFlight() < best.InFlight() {
+			best = h
+		}
+	}
+	return best
+}
+
+/// 轮流
+type roundRobin struct {
+	next uint32
+}
+
+func (r *roundRobin) Select(hubs []*ClientHub, src net.Addr) *ClientHub {
+	return hubs[int(atomic.AddUint32(&r.next, 1)-1)%len(hubs)]
+}
+
+/// 同一个来源IP总是使用同一个tunnel序号的hub. 用rendezvous hash, tunnel重连或者断开时只影响用到它的IP.
+type stickyIP struct{}
+
+func (stickyIP) Select(hubs []*ClientHub, src net.Addr) *ClientHub {
+	ip := ""
+	if src != nil {
+		ip = addrIP(src)
+	}
+	var best *ClientHub
+	var bestScore uint64
+	for _, h := range hubs {
+		f := fnv.New64a()
+		f.Write([]byte(ip))
+		f.Write([]byte{byte(h.index), byte(h.index >> 8)})
+		if s := f.Sum64(); best == nil || s > bestScore {
+			best, bestScore = h, s
+		}
+	}
+	return best
+}
+
+var selectorList = map[string]func() HubSelector{
+	"leastlinks": func() HubSelector { return leastLinks{} },
+	"rtt":        func() HubSelector { return lowestRTT{} },
+	"inflight":   func() HubSelector { return leastInFlight{} },
+	"roundrobin": func() HubSelector { return &roundRobin{} },
+	"sticky":     func() HubSelector { return stickyIP{} },
+}
+
+const DefaultSelector = "leastlinks"
+
+var ErrSelectorNotSupported = errors.New("hub selector not supported")
+
+/// ListSelector returns a list of available hub selector names
+func ListSelector() string {
+	var l []string
+	for k := range selectorList {
+		l = append(l, k)
+	}
+	sort.Strings(l)
+	return strings.Join(l, " ")
+}
+
+/// NewSelector returns a HubSelector of the given name
+func NewSelector(name string) (HubSelector, error) {
+	if f, ok := selectorList[strings.ToLower(name)]; ok {
+		return f(), nil
+	}
+	return nil, ErrSelectorNotSupported
+}
+
+/// 当前的link数
+func (h *ClientHub) Links() int {
+	return h.hPriority
+}
+
+/// tunnel序号
+func (h *ClientHub) Index() int {
+	return h.index
+}
+
+/// 最近的心跳RTT, 平滑之后的值. 0表示还没有测到.
+func (h *ClientHub) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&h.rttMs)) * time.Millisecond
+}
+
+/// 在途字节数. 协商了会话恢复时是对端还没有确认的字节;
+/// 否则是排队等待写入tunnel的字节加上还没有flush的字节, tunnel拥塞时写入会阻塞, 排队的字节增加.
+func (h *ClientHub) InFlight() int64 {
+	if h.sess != nil {
+		return atomic.LoadInt64(&h.sess.pendingBytes)
+	}
+	return atomic.LoadInt64(&h.tunnel.queued) + atomic.LoadInt64(&h.tunnel.unflushed)
+}
+
+/// 收到心跳的回应, 更新RTT
+func (h *ClientHub) onPong() {
+	sent := atomic.SwapInt64(&h.pingMs, 0)
+	if sent == 0 {
+		return
+	}
+	rtt := TimeNowMs() - sent
+	if old := atomic.LoadInt64(&h.rttMs); old > 0 {
+		rtt = (old*7 + rtt) / 8
+	}
+	if rtt <= 0 {
+		rtt = 1
+	}
+	atomic.StoreInt64(&h.rttMs, rtt)
+}
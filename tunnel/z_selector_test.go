@@ -0,0 +1,98 @@
+package tunnel
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func testHub(index, links int, rttMs int64) *ClientHub {
+	return &ClientHub{Hub: &Hub{tunnel: &Tunnel{}}, index: index, hPriority: links, rttMs: rttMs}
+}
+
+/// 同一个IP总是选中同一个hub, 端口不影响; 去掉一个hub时只有用它的IP改变.
+func TestSelectorSticky(t *testing.T) {
+	hubs := []*ClientHub{testHub(0, 0, 0), testHub(1, 0, 0), testHub(2, 0, 0), testHub(3, 0, 0)}
+	rest := []*ClientHub{hubs[0], hubs[1], hubs[3]}
+	used := map[*ClientHub]int{}
+	for i := 0; i < 200; i++ {
+		ip := net.ParseIP(fmt.Sprintf("10.0.%d.%d", i/250, i%250+1))
+		h := (stickyIP{}).Select(hubs, &net.TCPAddr{IP: ip, Port: 1000 + i})
+		used[h]++
+		for port := 1; port < 4; port++ {
+			if again := (stickyIP{}).Select(hubs, &net.TCPAddr{IP: ip, Port: port}); again != h {
+				t.Fatalf("%s moved from hub %d to %d", ip, h.index, again.index)
+			}
+		}
+		moved := (stickyIP{}).Select(rest, &net.TCPAddr{IP: ip, Port: 1})
+		if h != hubs[2] && moved != h {
+			t.Fatalf("%s moved from hub %d to %d after hub 2 left", ip, h.index, moved.index)
+		}
+	}
+	if len(used) != len(hubs) {
+		t.Fatalf("ips spread over %d of %d hubs", len(used), len(hubs))
+	}
+}
+
+func TestSelectorRoundRobin(t *testing.T) {
+	hubs := []*ClientHub{testHub(0, 5, 0), testHub(1, 0, 0), testHub(2, 9, 0)}
+	rr, _ := NewSelector("roundrobin")
+	for i := 0; i < 2*len(hubs); i++ {
+		if h := rr.Select(hubs, nil); h != hubs[i%len(hubs)] {
+			t.Fatalf("select %d: got hub %d", i, h.index)
+		}
+	}
+}
+
+/// RTT相同时选link少的, 还没有测到RTT的优先.
+func TestSelectorRTT(t *testing.T) {
+	hubs := []*ClientHub{testHub(0, 3, 20), testHub(1, 1, 50), testHub(2, 2, 20)}
+	if h := (lowestRTT{}).Select(hubs, nil); h != hubs[2] {
+		t.Fatalf("tie-break chose hub %d", h.index)
+	}
+	hubs = append(hubs, testHub(3, 7, 0))
+	if h := (lowestRTT{}).Select(hubs, nil); h != hubs[3] {
+		t.Fatalf("unmeasured hub not preferred, chose %d", h.index)
+	}
+}
+
+/// 没有会话恢复时, 写入阻塞的tunnel在途字节增加, 不再被选中.
+func TestSelectorInFlightNoSession(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	busy := &ClientHub{Hub: &Hub{tunnel: newTunnel(c1)}, index: 0}
+	idle := testHub(1, 0, 0)
+	hubs := []*ClientHub{busy, idle}
+	if h := (leastInFlight{}).Select(hubs, nil); h != busy {
+		t.Fatal("idle tunnels should tie")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 4; i++ {
+			if busy.tunnel.WritePacket(1, mpool.Get(TunnelPacketSize/2), FlushNow) != nil {
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for busy.InFlight() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("blocked writes not counted")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if h := (leastInFlight{}).Select(hubs, nil); h != idle {
+		t.Fatal("congested tunnel selected")
+	}
+
+	go io.Copy(io.Discard, c2)
+	<-done
+	if n := busy.InFlight(); n != 0 {
+		t.Fatalf("%d bytes still in flight after the writes finished", n)
+	}
+}
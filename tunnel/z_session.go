@@ -0,0 +1,386 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/// 会话恢复.
+/// tunnel断开之后, 两端在ResumeTimeout之内保留所有link. client重新连接, 在握手时出示ticket, 新的连接接替原来的tunnel.
+/// 每一端对发出的packet按顺序编号, 保存到对端确认为止. 接收方定期用CD_ACK确认收到的packet数;
+/// 恢复时双方用CD_RESUME告知收到的packet数, 对端从这里开始重发, 所以link的数据不会丢失也不会重复.
+var (
+	ResumeTimeout = time.Second * 30 // 断开之后保留会话的时间, 0表示不使用会话恢复
+	ResumeBuffer  = 8 << 20          // 每个会话未确认数据的上限, 超出时暂停从kconn读取
+)
+
+const (
+	ackPackets = 32                     // 每收到这么多packet确认一次
+	ackDelay   = time.Millisecond * 150 // 不够ackPackets时, 收到第一个未确认的packet之后最多等待这么久确认
+)
+
+type Ticket [16]byte
+
+func newTicket() (t Ticket) {
+	rand.Read(t[:])
+	return
+}
+
+func (t Ticket) IsZero() bool {
+	return t == Ticket{}
+}
+
+func (t Ticket) String() string {
+	return fmt.Sprintf("%x", t[:4])
+}
+
+/// CD_ACK, CD_RESUME附带确认的packet数
+type CtrlSeq struct {
+	Code   uint8
+	LinkId uint32
+	Seq    uint64
+}
+
+type pendingPacket struct {
+	id   uint32
+	data []byte
+}
+
+/// 锁: wmux保证pending的顺序和写入tunnel的顺序相同, 写入tunnel时持有, 读goroutine从不获取它.
+/// mux只保护状态, 持有期间不会阻塞在tunnel上. 需要两个时先获取wmux.
+type session struct {
+	ticket       Ticket
+	pendingBytes int64 // 持有mux时修改, 可以用atomic读取
+
+	wmux     sync.Mutex // 发送的顺序
+	mux      sync.Mutex
+	cond     *sync.Cond
+	sent     uint64          // 已发出的packet数
+	acked    uint64          // 对端确认收到的packet数, 即pending[0]的序号
+	pending  []pendingPacket // 未确认的packet
+	attached bool            // 有可用的tunnel
+	live     bool            // 对端已经确认恢复, 可以直接发送. 之前的数据只放入pending
+	expired  bool            // 会话结束, 不再恢复
+	gen      uint32          // 每次断开加1, 用于超时判断
+
+	recvd     uint64        // 收到的packet数, 只由读goroutine修改, 其他goroutine用atomic读取
+	ackedRecv uint64        // 上一次确认给对端的recvd
+	ackBytes  int           // 上一次确认之后收到的字节数
+	ackCh     chan struct{} // 读goroutine通知ackLoop发送CD_ACK
+	delayCh   chan struct{} // 读goroutine通知ackLoop有未确认的packet, 延迟确认
+}
+
+func newSession(t Ticket) *session {
+	s := &session{ticket: t, attached: true, live: true, ackCh: make(chan struct{}, 1), delayCh: make(chan struct{}, 1)}
+	s.cond = sync.NewCond(&s.mux)
+	return s
+}
+
+func (s *session) isExpired() bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.expired
+}
+
+/// 结束会话, 释放未确认的数据.
+func (s *session) expire() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.expired = true
+	s.ackTo(s.sent)
+	s.cond.Broadcast()
+}
+
+/// 丢弃对端已经收到的packet, 调用者持有mux.
+func (s *session) ackTo(seq uint64) {
+	for s.acked < seq && len(s.pending) > 0 {
+		p := s.pending[0]
+		s.pending[0] = pendingPacket{}
+		s.pending = s.pending[1:]
+		atomic.AddInt64(&s.pendingBytes, -int64(len(p.data)))
+		mpool.Put(p.data)
+		s.acked++
+	}
+	s.cond.Broadcast()
+}
+
+/// 有会话时的Hub.Send. 数据先保存到pending, tunnel可用时再发送; tunnel不可用时等待恢复之后重发.
+func (h *Hub) sendSession(id uint32, data []byte, flush FlushMode) bool {
+	s := h.sess
+	s.wmux.Lock()
+	defer s.wmux.Unlock()
+	s.mux.Lock()
+	if s.expired {
+		s.mux.Unlock()
+		mpool.Put(data)
+		return false
+	}
+	saved := mpool.Get(len(data))
+	copy(saved, data)
+	s.pending = append(s.pending, pendingPacket{id, saved})
+	atomic.AddInt64(&s.pendingBytes, int64(len(saved)))
+	s.sent++
+	live := s.live
+	s.mux.Unlock()
+
+	if !live {
+		mpool.Put(data)
+		return true
+	}
+	if err := h.tunnel.WritePacket(id, data, flush); err != nil {
+		// 读goroutine会发现tunnel断开, 等待恢复
+		s.mux.Lock()
+		s.live = false
+		s.mux.Unlock()
+		WarnEvent("tunnel_write_failed", h.fields(id).With(LogFields{FieldReason: err}))
+	}
+	return true
+}
+
+/// 发送CD_ACK, CD_RESUME, CD_SESSION_END. 它们不编号, 也不重发, 不需要持有锁.
+func (h *Hub) sendSeq(code uint8, seq uint64, flush FlushMode) error {
+	buf := bytes.NewBuffer(mpool.Get(0))
+	binary.Write(buf, TByteOrder, &CtrlSeq{code, 0, seq})
+	return h.tunnel.WritePacket(0, buf.Bytes(), flush)
+}
+
+/// 发送CD_ACK. 读goroutine只发通知, 不阻塞在tunnel的写入上, 否则两端的读goroutine可能互相等待.
+/// 收到的packet不够ackPackets时, 在第一个未确认的packet之后ackDelay确认, 流量很小的tunnel也能释放对端的pending.
+func (h *Hub) ackLoop() {
+	defer Recover()
+	s := h.sess
+	var delay <-chan time.Time
+	var sent uint64 // 上一次确认的recvd
+	for {
+		select {
+		case _, ok := <-s.ackCh:
+			if !ok {
+				return
+			}
+		case <-s.delayCh:
+			if delay == nil {
+				delay = time.After(ackDelay)
+			}
+			continue
+		case <-delay:
+		}
+		delay = nil
+		recvd := atomic.LoadUint64(&s.recvd)
+		if recvd == sent {
+			continue
+		}
+		s.mux.Lock()
+		live := s.live && !s.expired
+		s.mux.Unlock()
+		if live && h.sendSeq(CD_ACK, recvd, FlushIdle) == nil {
+			sent = recvd
+		}
+	}
+}
+
+/// 读goroutine收到一个packet. 处理CD_ACK, CD_RESUME, CD_SESSION_END时返回true, 其他packet计数并按需确认.
+func (h *Hub) onSessionPacket(linkId uint32, data []byte) bool {
+	s := h.sess
+	if linkId == 0 && len(data) == binary.Size(CtrlSeq{}) && data[0] >= CD_ACK && data[0] <= CD_SESSION_END {
+		var cmd CtrlSeq
+		binary.Read(bytes.NewBuffer(data), TByteOrder, &cmd)
+		DebugEvent("recv_cmd", h.fields(0).With(LogFields{"code": cmd.Code, "seq": cmd.Seq}))
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		if cmd.Code == CD_SESSION_END {
+			s.expired = true
+			s.ackTo(s.sent)
+			h.tunnel.shutdown() // 不等待可能阻塞的写者
+			h.tunnel.Close()
+			InfoEvent("session_end", h.fields(0).With(LogFields{"ticket": s.ticket}))
+			return true
+		}
+		if cmd.Seq > s.sent || cmd.Seq < s.acked {
+			Error("%s bad %s seq %d, sent %d, acked %d", h.tunnel, ctrlName(cmd.Code), cmd.Seq, s.sent, s.acked)
+			h.tunnel.shutdown()
+			h.tunnel.Close()
+			return true
+		}
+		s.ackTo(cmd.Seq)
+		if cmd.Code == CD_RESUME && s.attached && !s.live {
+			// 两端同时重发, 不能在读goroutine里写, 否则socket缓冲满时互相等待
+			go h.replay(s.gen)
+		}
+		return true
+	}
+
+	atomic.StoreUint64(&s.recvd, s.recvd+1)
+	s.ackBytes += len(data)
+	if s.recvd-s.ackedRecv >= ackPackets || s.ackBytes >= ResumeBuffer/4 {
+		select {
+		case s.ackCh <- struct{}{}:
+		default: // ackLoop还没有处理上一次通知, 它会发送最新的recvd
+		}
+		s.ackedRecv, s.ackBytes = s.recvd, 0
+	} else {
+		select {
+		case s.delayCh <- struct{}{}:
+		default: // ackLoop已经在等待延迟确认
+		}
+	}
+	return false
+}
+
+/// 对端确认恢复之后, 按顺序重发它还没有收到的packet. 持有wmux, 新的数据排在重发的数据之后.
+/// 每次只在mux下复制一个packet, 读goroutine可以同时处理CD_ACK.
+func (h *Hub) replay(gen uint32) {
+	defer Recover()
+	s := h.sess
+	s.wmux.Lock()
+	defer s.wmux.Unlock()
+	var packets, size int
+	for seq := s.acked; ; seq++ {
+		s.mux.Lock()
+		if s.expired || !s.attached || s.live || s.gen != gen {
+			s.mux.Unlock()
+			return
+		}
+		if seq < s.acked { // 重发期间对端确认了更多
+			seq = s.acked
+		}
+		i := int(seq - s.acked)
+		if i >= len(s.pending) {
+			s.live = true
+			s.mux.Unlock()
+			break
+		}
+		p := s.pending[i]
+		data := mpool.Get(len(p.data))
+		copy(data, p.data)
+		last := i == len(s.pending)-1
+		s.mux.Unlock()
+
+		flush := FlushLazy
+		if last {
+			flush = FlushNow
+		}
+		if err := h.tunnel.WritePacket(p.id, data, flush); err != nil {
+			return
+		}
+		packets, size = packets+1, size+len(p.data)
+	}
+	InfoEvent("session_replay", h.fields(0).With(LogFields{"packets": packets, FieldBytes: size}))
+}
+
+/// 读goroutine发现tunnel断开之后调用, 等待新的连接接替. 超时或者会话结束时返回false.
+func (h *Hub) waitResume() bool {
+	s := h.sess
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.expired {
+		return false
+	}
+	s.attached, s.live = false, false
+	s.gen++
+	s.cond.Broadcast()
+	WarnEvent("session_detached", h.fields(0).With(LogFields{"ticket": s.ticket, "pending": len(s.pending)}))
+
+	gen := s.gen
+	timer := time.AfterFunc(ResumeTimeout, func() {
+		s.mux.Lock()
+		defer s.mux.Unlock()
+		if !s.attached && s.gen == gen {
+			s.expired = true
+			s.cond.Broadcast()
+		}
+	})
+	defer timer.Stop()
+	if h.onDetach != nil {
+		go h.onDetach()
+	}
+
+	for !s.attached && !s.expired {
+		s.cond.Wait()
+	}
+	if s.expired {
+		WarnEvent("session_expired", h.fields(0).With(LogFields{"ticket": s.ticket}))
+		return false
+	}
+	return true
+}
+
+/// 用新的连接t接替断开的tunnel. 原来的tunnel可能还没有发现断开, 先关闭它, 等读goroutine进入waitResume.
+/// 等待时不持有wmux: 读goroutine回复命令时也要获取wmux.
+func (h *Hub) attach(t *Tunnel) bool {
+	s := h.sess
+	h.tunnel.shutdown() // 读写的goroutine都可能阻塞在断开的连接上
+	h.tunnel.Close()
+	s.mux.Lock()
+	for s.attached && !s.expired {
+		s.cond.Wait()
+	}
+	s.mux.Unlock()
+
+	s.wmux.Lock() // 等正在写入的goroutine失败退出, 它们的数据不能写到新的连接上
+	defer s.wmux.Unlock()
+	s.mux.Lock()
+	if s.attached && !s.expired { // 同时恢复的另一个连接已经接替
+		s.mux.Unlock()
+		return false
+	}
+	if s.expired || !h.tunnel.adopt(t) {
+		s.expired = true
+		s.cond.Broadcast()
+		s.mux.Unlock()
+		return false
+	}
+	s.attached = true
+	// 读goroutine还在waitResume中等待, 可以修改它的字段
+	s.ackedRecv, s.ackBytes = s.recvd, 0
+	recvd, pending := s.recvd, len(s.pending)
+	s.cond.Broadcast()
+	s.mux.Unlock()
+	// 告诉对端本端收到的packet数, 对端从这里开始重发. 之后的数据等对端的CD_RESUME再发送.
+	h.sendSeq(CD_RESUME, recvd, FlushNow)
+	WarnEvent("session_resumed", h.fields(0).With(LogFields{"ticket": s.ticket, "pending": pending}))
+	return true
+}
+
+/// link从kconn读取之前调用. 未确认的数据太多时等待, 避免tunnel断开期间无限缓存.
+func (h *Hub) waitRoom() {
+	s := h.sess
+	if s == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for s.pendingBytes > int64(ResumeBuffer) && !s.expired {
+		s.cond.Wait()
+	}
+}
+
+/// 主动结束会话, 通知对端不必等待恢复.
+func (h *Hub) endSession() {
+	s := h.sess
+	s.mux.Lock()
+	live := s.live && !s.expired
+	s.expired = true
+	s.ackTo(s.sent)
+	s.mux.Unlock()
+	if live {
+		h.sendSeq(CD_SESSION_END, atomic.LoadUint64(&s.recvd), FlushNow)
+	}
+}
+
+/// 没有hub的tunnel上发送CD_SESSION_END: client要恢复的会话已经不在. client已经用这个连接接替了断开的tunnel, 收到之后结束会话.
+func sendSessionLost(t *Tunnel) {
+	buf := bytes.NewBuffer(mpool.Get(0))
+	binary.Write(buf, TByteOrder, &CtrlSeq{CD_SESSION_END, 0, 0})
+	t.WritePacket(0, buf.Bytes(), FlushNow)
+}
+
+func (s *session) String() string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return fmt.Sprintf("session(%s) sent %d, acked %d, pending %dB", s.ticket, s.sent, s.acked, s.pendingBytes)
+}
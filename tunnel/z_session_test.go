@@ -0,0 +1,52 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+/// 认证之前, 不管会话是否还在server都回复client的ticket; 认证之后才用CD_SESSION_END告知会话已经不在.
+func TestResumeLostSession(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", "127.0.0.1:1", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.listener.Close() })
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	go s.handleConn(c1, "127.0.0.1", nil)
+
+	tun := newTunnel(c2)
+	local := localFeatures()
+	local.Ticket = newTicket()
+	offered := local.toBytes()
+	helloA := newHelloA("secret")
+	if err := tun.WritePacket(0, append(helloA.toBytes(), offered...), FlushNow); err != nil {
+		t.Fatal(err)
+	}
+	_, helloB, err := tun.ReadPacket()
+	if err != nil || len(helloB) <= TaaBlockSize {
+		t.Fatalf("challenge: %d bytes, %v", len(helloB), err)
+	}
+	f, ok := parseFeatures(helloB[TaaBlockSize:])
+	if !ok || !f.Resume || f.Ticket != local.Ticket {
+		t.Fatalf("challenge ticket %v, offered %v", f.Ticket, local.Ticket)
+	}
+
+	taa := NewTaa("secret")
+	taa.BindFeatures(offered, helloB[TaaBlockSize:])
+	helloC, err := taa.ExchangeCipherBlock(helloB[:TaaBlockSize])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tun.WritePacket(0, helloC, FlushNow); err != nil {
+		t.Fatal(err)
+	}
+	tun.tconn.setKeys(taa.Token, "secret", f.cipher(), true)
+	tun.setFeatures(f)
+	_, data, err := tun.ReadPacket()
+	if err != nil || len(data) != binary.Size(CtrlSeq{}) || data[0] != CD_SESSION_END {
+		t.Fatalf("after auth: %v %v, want CD_SESSION_END", data, err)
+	}
+}
@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+/// 流量计数, 可以并发更新.
+/// 作为结构体的第一个字段, 保证32位平台上64位原子操作的对齐.
+type TrafficStats struct {
+	BytesIn    uint64
+	BytesOut   uint64
+	PacketsIn  uint64
+	PacketsOut uint64
+}
+
+func (s *TrafficStats) addIn(n int) {
+	atomic.AddUint64(&s.BytesIn, uint64(n))
+	atomic.AddUint64(&s.PacketsIn, 1)
+}
+
+func (s *TrafficStats) addOut(n int) {
+	atomic.AddUint64(&s.BytesOut, uint64(n))
+	atomic.AddUint64(&s.PacketsOut, 1)
+}
+
+/// 返回当前计数的拷贝.
+func (s *TrafficStats) Snapshot() TrafficStats {
+	return TrafficStats{
+		BytesIn:    atomic.LoadUint64(&s.BytesIn),
+		BytesOut:   atomic.LoadUint64(&s.BytesOut),
+		PacketsIn:  atomic.LoadUint64(&s.PacketsIn),
+		PacketsOut: atomic.LoadUint64(&s.PacketsOut),
+	}
+}
+
+func (s TrafficStats) String() string {
+	return fmt.Sprintf("in %dB/%dp, out %dB/%dp", s.BytesIn, s.PacketsIn, s.BytesOut, s.PacketsOut)
+}
@@ -0,0 +1,39 @@
+package tunnel
+
+import (
+	"net"
+	"testing"
+)
+
+/// 发送方和接收方按同样的方式计数: 每个packet加上header的长度.
+func TestTunnelStats(t *testing.T) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	w, r := newTunnel(c1), newTunnel(c2)
+	before := TotalStats.Snapshot()
+
+	sizes := []int{10, 100, 1000}
+	go func() {
+		for _, n := range sizes {
+			w.WritePacket(1, mpool.Get(n), FlushNow)
+		}
+	}()
+	for range sizes {
+		if _, data, err := r.ReadPacket(); err != nil {
+			t.Fatal(err)
+		} else {
+			mpool.Put(data)
+		}
+	}
+
+	want := uint64(3*headerSize + 1110)
+	if st := w.Stats(); st.BytesOut != want || st.PacketsOut != 3 || st.BytesIn != 0 || st.PacketsIn != 0 {
+		t.Fatalf("writer %s, want out %dB/3p", st, want)
+	}
+	if st := r.Stats(); st.BytesIn != want || st.PacketsIn != 3 || st.BytesOut != 0 || st.PacketsOut != 0 {
+		t.Fatalf("reader %s, want in %dB/3p", st, want)
+	}
+	if st := TotalStats.Snapshot(); st.BytesOut-before.BytesOut < want || st.PacketsIn-before.PacketsIn < 3 { // 其他测试留下的tunnel也会计数
+		t.Fatalf("total %s, before %s", st, before)
+	}
+}
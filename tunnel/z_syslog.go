@@ -0,0 +1,26 @@
+// +build !windows
+
+package tunnel
+
+import (
+	"log/syslog"
+
+	"github.com/op/go-logging"
+)
+
+/// 日志输出到syslog. network为空时连接本机syslog,
+/// 否则连接指定地址, 例如 unixgram:/dev/log, udp:127.0.0.1:514.
+func InitSyslogLogger(network, raddr string, pre uint16) error {
+	w, err := syslog.Dial(network, raddr, syslog.LOG_WARNING|syslog.LOG_DAEMON, "dktunnel")
+	if err != nil {
+		return err
+	}
+
+	var ft logging.Formatter = format_syslog
+	if LogFormat == LogFormatJSON {
+		ft = &jsonFormatter{app: pre}
+	}
+	backend := logging.NewBackendFormatter(&logging.SyslogBackend{Writer: w}, ft)
+	logging.SetBackend(backend)
+	return nil
+}
@@ -0,0 +1,9 @@
+package tunnel
+
+import (
+	"errors"
+)
+
+func InitSyslogLogger(network, raddr string, pre uint16) error {
+	return errors.New("syslog is not supported on windows")
+}
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"fmt"
 	"net"
 	"time"
 )
@@ -29,9 +30,17 @@ func newTcpListener(laddr string) (*net.TCPListener, error) {
 	return tl, nil
 }
 
-// for client
-func dialTcp(raddr string) (net.Conn, error) {
-	conn, err := net.DialTimeout("tcp", raddr, 5*time.Second)
+// for client. laddr是本地IP, 为空时由系统选择. 多条线路时用来指定出口.
+func dialTcp(network, laddr, raddr string) (net.Conn, error) {
+	d := net.Dialer{Timeout: 5 * time.Second}
+	if laddr != "" {
+		ip := net.ParseIP(laddr)
+		if ip == nil {
+			return nil, fmt.Errorf("bad local address %s", laddr)
+		}
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+	conn, err := d.Dial(network, raddr)
 	if err != nil {
 		return nil, err
 	}
@@ -45,6 +54,6 @@ func newListener(laddr string) (net.Listener, error) {
 	return newTcpListener(laddr)
 }
 
-func dial(raddr string) (net.Conn, error) {
-	return dialTcp(raddr)
+func dial(network, laddr, raddr string) (net.Conn, error) {
+	return dialTcp(network, laddr, raddr)
 }
\ No newline at end of file
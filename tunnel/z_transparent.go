@@ -0,0 +1,77 @@
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+/// 透明代理(仅Linux client): iptables把任意目的地址的连接转到client的监听端口, client取得原始目的地址,
+/// 在CD_LINK_CREATE中交给server(featDirect), server直接连接这个地址而不是backend.
+/// redirect: iptables -t nat -j REDIRECT, 用SO_ORIGINAL_DST取得原始地址.
+/// tproxy: iptables -t mangle -j TPROXY, 监听socket设置IP_TRANSPARENT, 连接的本地地址就是原始地址.
+/// server只允许连接DirectAllowed中的地址, 为空时不支持透明代理.
+const (
+	TransparentRedirect = "redirect"
+	TransparentTProxy   = "tproxy"
+)
+
+var DirectAllowed []*net.IPNet // server: 透明代理允许连接的目的地址
+
+var ErrTransparentNotSupported = errors.New("transparent proxy is only supported on linux")
+
+/// 是否是支持的透明代理模式, 空表示不使用.
+func ValidTransparent(mode string) bool {
+	return mode == "" || mode == TransparentRedirect || mode == TransparentTProxy
+}
+
+/// 取得透明代理的连接原本要连接的地址.
+func originalDst(mode string, conn net.Conn) (*net.TCPAddr, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("transparent proxy needs tcp, got %s", conn.LocalAddr().Network())
+	}
+	if mode == TransparentTProxy {
+		dst, _ := tc.LocalAddr().(*net.TCPAddr)
+		return dst, nil
+	}
+	return redirectDst(tc)
+}
+
+/// client取得透明代理的目的地址. server不支持, 或者连接本来就是连接监听地址(会形成环路)时拒绝.
+func (cli *Client) directDst(h *Hub, conn net.Conn) (*net.TCPAddr, error) {
+	if !h.direct {
+		return nil, errors.New("server does not allow direct links")
+	}
+	dst, err := originalDst(cli.Transparent, conn)
+	if err != nil {
+		return nil, err
+	}
+	if l, ok := cli.listenAddr.(*net.TCPAddr); ok && dst.Port == l.Port && (l.IP.IsUnspecified() || l.IP.Equal(dst.IP)) {
+		return nil, fmt.Errorf("destination %v is the listener", dst)
+	}
+	return dst, nil
+}
+
+/// server处理透明代理的link: 直接连接目的地址, 不写PROXY protocol的头. 只允许DirectAllowed中的地址.
+func (h *ServerHub) handleDirectLink(k *Link) {
+	var conn net.Conn
+	var err error
+	reason := "direct_denied"
+	if k.dstAddr != nil && ipInNets(DirectAllowed, k.dstAddr.IP) {
+		reason = "dial_failed"
+		d := net.Dialer{Timeout: BackendDialTimeout}
+		conn, err = d.Dial("tcp", k.dstAddr.String())
+	} else {
+		err = fmt.Errorf("destination not allowed")
+	}
+	if err != nil {
+		WarnEvent("direct_dial_failed", h.fields(k.id).With(LogFields{FieldBackend: linkAddrString(k.dstAddr, nil),
+			FieldReason: err}))
+		k.setCloseReason(CloseSideLocal, reason)
+		h.SendCmd(k.id, CD_LINK_CLOSE)
+		h.accessLog(k, linkAddrString(k.srcAddr, nil), linkAddrString(k.dstAddr, nil))
+		return
+	}
+	h.runLink(k, conn.(halfConn))
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+const transparentSupported = true
+
+const (
+	soOriginalDst   = 80 // SO_ORIGINAL_DST, IP6T_SO_ORIGINAL_DST
+	ipTransparent   = 19 // IP_TRANSPARENT
+	ipv6Transparent = 75 // IPV6_TRANSPARENT
+)
+
+/// REDIRECT之后的原始目的地址. syscall包没有通用的getsockopt,
+/// 借用大小足够的结构: IPv6Mreq装得下sockaddr_in, IPv6MTUInfo以sockaddr_in6开头.
+func redirectDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	var dst *net.TCPAddr
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		if local != nil && local.IP.To4() != nil {
+			mreq, e := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if serr = e; e == nil {
+				b := mreq.Multiaddr[:]
+				dst = &net.TCPAddr{IP: net.IPv4(b[4], b[5], b[6], b[7]), Port: int(binary.BigEndian.Uint16(b[2:]))}
+			}
+			return
+		}
+		info, e := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, soOriginalDst)
+		if serr = e; e == nil {
+			port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port))[:] // 网络字节序
+			dst = &net.TCPAddr{IP: append(net.IP(nil), info.Addr.Addr[:]...), Port: int(binary.BigEndian.Uint16(port))}
+		}
+	})
+	if err == nil {
+		err = serr
+	}
+	return dst, err
+}
+
+/// TPROXY的监听socket需要IP_TRANSPARENT, 才能接受目的地址不是本机的连接. 需要CAP_NET_ADMIN.
+func listenTProxy(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var serr error
+		err := c.Control(func(fd uintptr) {
+			if serr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, ipTransparent, 1); serr != nil {
+				return
+			}
+			if network == "tcp6" || network == "tcp" {
+				// 双栈socket也要接受IPv6的连接, 纯IPv4的socket设置失败时忽略
+				syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+			}
+		})
+		if err != nil {
+			return err
+		}
+		return serr
+	}}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
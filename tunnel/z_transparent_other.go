@@ -0,0 +1,17 @@
+// +build !linux
+
+package tunnel
+
+import (
+	"net"
+)
+
+const transparentSupported = false
+
+func redirectDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, ErrTransparentNotSupported
+}
+
+func listenTProxy(addr string) (net.Listener, error) {
+	return nil, ErrTransparentNotSupported
+}
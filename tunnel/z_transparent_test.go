@@ -0,0 +1,154 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+/// 透明代理的link在CD_LINK_CREATE中带上原始目的地址和direct标记.
+func TestDirectLinkCreate(t *testing.T) {
+	f := Features{ExtHeader: true, Addr: true, Direct: true}
+	for _, c := range []struct{ src, dst string }{
+		{"192.0.2.1:5000", "198.51.100.7:443"},
+		{"[2001:db8::1]:5000", "[2001:db8::2]:443"},
+	} {
+		h, peer := pipeHub(t, f)
+		h.linkAddrs = true
+		r := newTunnel(peer)
+		r.setFeatures(f)
+
+		k := h.allocLink()
+		k.srcAddr, _ = net.ResolveTCPAddr("tcp", c.src)
+		k.dstAddr, _ = net.ResolveTCPAddr("tcp", c.dst)
+		k.direct = true
+		go h.sendCreate(k)
+
+		_, data, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := binary.Size(Ctrl{})
+		src, dst, direct := parseLinkAddrs(data[n:])
+		if data[0] != CD_LINK_CREATE || !direct || src.String() != c.src || dst.String() != c.dst {
+			t.Fatalf("create %v: src %v dst %v direct %v", data[:n], src, dst, direct)
+		}
+	}
+}
+
+/// server只直接连接DirectAllowed中的地址, 其他的link关闭.
+func TestDirectLinkDenied(t *testing.T) {
+	ExitOnError = false
+	t.Cleanup(func() { ExitOnError = true })
+
+	hub, peer := pipeHub(t, Features{ExtHeader: true})
+	h := &ServerHub{Hub: hub}
+	h.role = RoleServer
+	k := h.createLink(5)
+	k.dstAddr = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 80}
+	k.direct = true
+
+	r := newHub(newTunnel(peer), RoleClient)
+	r.tunnel.setFeatures(Features{ExtHeader: true})
+	go h.handleDirectLink(k)
+	_, data, err := r.tunnel.ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cmd, err := r.parseCtrl(data); err != nil || cmd.Code != CD_LINK_CLOSE || cmd.LinkId != 5 {
+		t.Fatalf("ctrl %+v %v, want CD_LINK_CLOSE", cmd, err)
+	}
+	if k.closeReason != "direct_denied" {
+		t.Fatalf("close reason %q", k.closeReason)
+	}
+}
+
+/// client: server不允许时, 以及目的地址就是监听地址(形成环路)时拒绝.
+func TestDirectDst(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		if c, err := net.Dial("tcp", l.Addr().String()); err == nil {
+			defer c.Close()
+			c.Read(make([]byte, 1))
+		}
+	}()
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	cli := &Client{Transparent: TransparentTProxy, listenAddr: l.Addr()}
+	h := &Hub{}
+	if _, err := cli.directDst(h, conn); err == nil {
+		t.Fatal("accepted without server support")
+	}
+	h.direct = true
+	if _, err := cli.directDst(h, conn); err == nil {
+		t.Fatal("accepted the listener as destination")
+	}
+}
+
+/// 没有协商透明代理的client在CD_LINK_CREATE中设置了direct标记: server仍然连接backend.
+func TestDirectNotNegotiated(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	DirectAllowed = []*net.IPNet{loopback}
+	t.Cleanup(func() { DirectAllowed = nil })
+
+	accepted := func() (net.Listener, chan struct{}) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { l.Close() })
+		ch := make(chan struct{}, 1)
+		go func() {
+			if c, err := l.Accept(); err == nil {
+				t.Cleanup(func() { c.Close() })
+				ch <- struct{}{}
+			}
+		}()
+		return l, ch
+	}
+	backend, toBackend := accepted()
+	dst, toDst := accepted()
+
+	pool, err := newBackendPool(backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	tun := newTunnel(c1)
+	tun.setFeatures(Features{ExtHeader: true, Addr: true})
+	sh := newServerHub(tun, pool)
+	t.Cleanup(func() { // 对端结束发送, backend已经关闭. 等link的goroutine结束, 之后的测试会修改它读取的全局配置
+		sh.Hub.onCtrl(Ctrl{CD_LINK_CLOSE_ReadErr, 1}, nil)
+		for i := 0; i < 100 && sh.getLink(1) != nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if sh.getLink(1) != nil {
+			t.Error("link not closed")
+		}
+	})
+	t.Cleanup(func() { c1.Close(); c2.Close() })
+	go io.Copy(io.Discard, c2)
+
+	src := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5000}
+	addrs := encodeLinkAddrs(src, dst.Addr().(*net.TCPAddr))
+	addrs[0] |= linkAddrDirect
+	sh.onCtrl(Ctrl{CD_LINK_CREATE, 1}, addrs)
+
+	select {
+	case <-toBackend:
+	case <-toDst:
+		t.Fatal("connected to the direct destination")
+	case <-time.After(5 * time.Second):
+		t.Fatal("backend not connected")
+	}
+}
@@ -0,0 +1,69 @@
+package tunnel
+
+import (
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+/// link两端的本地连接: TCP或者unix socket, 都可以单独关闭读写方向.
+type halfConn interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+/// 解析unix:path或unix://path形式的地址, 不是unix地址时ok为false.
+func unixPath(addr string) (path string, ok bool) {
+	if !strings.HasPrefix(addr, "unix:") {
+		return "", false
+	}
+	return strings.TrimPrefix(addr[5:], "//"), true
+}
+
+/// client监听本地地址. unix:path监听unix socket, 先删除上次留下的socket文件.
+func listenLocal(addr string) (net.Listener, error) {
+	path, ok := unixPath(addr)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+/// TCP连接设置keepalive, unix socket不需要.
+func setKeepAlive(conn net.Conn, period time.Duration) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetKeepAlive(true)
+		tc.SetKeepAlivePeriod(period)
+	}
+}
+
+/// 关闭时发送RST而不是FIN. unix socket没有RST, 直接关闭.
+func setResetOnClose(conn net.Conn) {
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetLinger(0)
+	}
+}
+
+/// 连接地址用于日志. unix socket的对端通常没有名字.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if s := addr.String(); s != "" {
+		return s
+	}
+	return addr.Network()
+}
+
+/// link两端的地址. 未知时(如server没有协商link地址)用fallback.
+func linkAddrString(a *net.TCPAddr, fallback net.Addr) string {
+	if a != nil {
+		return a.String()
+	}
+	return addrString(fallback)
+}
@@ -0,0 +1,90 @@
+package ztests
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+/// 日志可能来自多个goroutine
+type lockedBuffer struct {
+	mux sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.buf.Write(p)
+}
+
+/// role记录的来自client的access记录, 没有时返回nil.
+func (b *lockedBuffer) access(role, client string) map[string]interface{} {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	for _, line := range bytes.Split(b.buf.Bytes(), []byte("\n")) {
+		var m map[string]interface{}
+		if json.Unmarshal(line, &m) == nil && m[tunnel.FieldEvent] == "access" && m[tunnel.FieldRole] == role &&
+			m[tunnel.FieldClient] == client {
+			return m
+		}
+	}
+	return nil
+}
+
+/// client字段是发起连接的地址, backend字段是link的目的地址, tunnel对端只在remote字段.
+/// 两端的link计数相同.
+func TestAccessLogAddrs(t *testing.T) {
+	logs := &lockedBuffer{}
+	tunnel.LogFormat = tunnel.LogFormatJSON
+	tunnel.InitLogger(logs, 1)
+	t.Cleanup(func() {
+		tunnel.LogFormat = tunnel.LogFormatText
+		tunnel.InitLogger(nil, 1)
+	})
+
+	saddr, backend := freeAddr(t), echoServer(t)
+	srv, err := tunnel.NewServer(saddr, backend, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runServer(t, srv)
+	caddr := startClient(t, saddr, nil)
+
+	c, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := c.LocalAddr().String()
+	c.Write([]byte("ping"))
+	c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.Read(make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	var cm, sm map[string]interface{}
+	for i := 0; i < 100 && (cm == nil || sm == nil); i++ {
+		time.Sleep(20 * time.Millisecond)
+		cm, sm = logs.access("client", src), logs.access("server", src)
+	}
+	if cm == nil || sm == nil {
+		t.Fatalf("missing access records: client %v, server %v", cm, sm)
+	}
+	if cm[tunnel.FieldBackend] != caddr || cm[tunnel.FieldRemote] != saddr {
+		t.Fatalf("client record: %v", cm)
+	}
+	if sm[tunnel.FieldBackend] != backend || sm[tunnel.FieldRemote] == saddr {
+		t.Fatalf("server record: %v", sm)
+	}
+	for _, m := range []map[string]interface{}{cm, sm} {
+		if m[tunnel.FieldBytesUp] != float64(4) || m[tunnel.FieldBytesDown] != float64(4) {
+			t.Fatalf("link bytes: %v", m)
+		}
+	}
+}
@@ -64,4 +64,32 @@ func TestAuth(t *testing.T) {
 	ta("abcdefg")
 	ta(tunnel.PASSWORD)
 
-}
\ No newline at end of file
+}
+/// 握手时附加的扩展计入MAC, 中间人改动任何一方的扩展都会认证失败.
+func TestAuthBindFeatures(t *testing.T) {
+	offered, chosen := []byte("AES-256-CTR,AES-128-CTR"), []byte("AES-256-CTR")
+	exchange := func(serverOffered, clientChosen []byte) error {
+		s, c := tunnel.NewTaa("secret"), tunnel.NewTaa("secret")
+		s.GenRandomToken()
+		s.BindFeatures(serverOffered, chosen)
+		c.BindFeatures(offered, clientChosen)
+		reply, err := c.ExchangeCipherBlock(s.GenCipherBlock(nil))
+		if err != nil {
+			return err
+		}
+		if !s.VerifyCipherBlock(reply) {
+			return fmt.Errorf("verify failed")
+		}
+		return nil
+	}
+
+	if err := exchange(offered, chosen); err != nil {
+		t.Fatalf("same features: %v", err)
+	}
+	if err := exchange([]byte("AES-128-CTR"), chosen); err == nil {
+		t.Fatal("rewritten offer accepted")
+	}
+	if err := exchange(offered, []byte("AES-128-CTR")); err == nil {
+		t.Fatal("rewritten choice accepted")
+	}
+}
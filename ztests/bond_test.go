@@ -0,0 +1,41 @@
+package ztests
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func startBondClient(t *testing.T, saddr string) string {
+	return startClient(t, saddr, func(cli *tunnel.Client) {
+		cli.Bond = true
+		cli.MinTunnels, cli.MaxTunnels = 3, 3
+	})
+}
+
+/// 捆绑3个tunnel, 多个link同时传输, 数据按顺序到达.
+func TestBondEcho(t *testing.T) {
+	saddr := freeAddr(t)
+	startServer(t, saddr)
+	caddr := startBondClient(t, saddr)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			echoThrough(t, caddr, 4<<20, nil)
+		}()
+	}
+	wg.Wait()
+}
+
+/// 捆绑的link半关闭之后, 已经收到的数据仍然写入本地连接.
+func TestBondHalfClose(t *testing.T) {
+	saddr := freeAddr(t)
+	startServer(t, saddr)
+	caddr := startBondClient(t, saddr)
+	for i := 0; i < 3; i++ {
+		halfCloseEcho(t, caddr, 4<<20)
+	}
+}
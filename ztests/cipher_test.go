@@ -0,0 +1,34 @@
+package ztests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func TestParseCiphers(t *testing.T) {
+	l, err := tunnel.ParseCiphers(tunnel.DefaultCiphers)
+	if err != nil || len(l) != 3 {
+		t.Fatalf("default: %v %v", l, err)
+	}
+	if l, err = tunnel.ParseCiphers(" aes-128-ctr,CHACHA20X "); err != nil || l[0] != "AES-128-CTR" || l[1] != "CHACHA20X" {
+		t.Fatalf("parse: %v %v", l, err)
+	}
+	if _, err = tunnel.ParseCiphers("AES-128-CTR,BLOWFISH"); err == nil {
+		t.Fatal("unknown cipher accepted")
+	}
+	for _, name := range []string{"DUMMY", "RC4-128", "RC4-256"} {
+		if _, err = tunnel.ParseCiphers(name); err == nil {
+			t.Fatalf("insecure %s accepted", name)
+		}
+	}
+	if _, err = tunnel.ParseCiphers(strings.Repeat("AES-128-CTR,", 30)); err == nil {
+		t.Fatal("list longer than 255 bytes accepted")
+	}
+	tunnel.AllowInsecureCipher = true
+	defer func() { tunnel.AllowInsecureCipher = false }()
+	if _, err = tunnel.ParseCiphers("RC4-128"); err != nil {
+		t.Fatalf("allowed insecure: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+package ztests
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+/// 双方都开启压缩时, 可以压缩的数据经过tunnel原样返回, 实际发送的字节更少.
+func TestCompressTunnel(t *testing.T) {
+	tunnel.Compression = tunnel.CompressSnappy
+	t.Cleanup(func() { tunnel.Compression = tunnel.CompressNone })
+	before := tunnel.TotalCompress.Snapshot()
+
+	saddr := freeAddr(t)
+	startServer(t, saddr)
+	c, err := net.Dial("tcp", startClient(t, saddr, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := bytes.Repeat([]byte("compressible text "), 64<<10)
+	go c.Write(data)
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(c, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("echo mismatch")
+	}
+
+	after := tunnel.TotalCompress.Snapshot()
+	raw, wire := after.RawBytes-before.RawBytes, after.WireBytes-before.WireBytes
+	if raw < uint64(len(data)) || wire >= raw/2 {
+		t.Fatalf("compressed %d raw bytes to %d", raw, wire)
+	}
+}
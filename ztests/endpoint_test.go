@@ -0,0 +1,66 @@
+package ztests
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func ep(network, addr string, weight int) tunnel.Endpoint {
+	return tunnel.Endpoint{Network: network, Addr: addr, Weight: weight}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want []tunnel.Endpoint // nil表示解析失败
+	}{
+		{"1.2.3.4:5555", []tunnel.Endpoint{ep("tcp", "1.2.3.4:5555", 0)}},
+		{" a:1 , b:2 ,", []tunnel.Endpoint{ep("tcp", "a:1", 0), ep("tcp", "b:2", 0)}},
+		{"a:1@3,b:2@1", []tunnel.Endpoint{ep("tcp", "a:1", 3), ep("tcp", "b:2", 1)}},
+		{"tcp6://[::1]:80,TCP4://127.0.0.1:81", []tunnel.Endpoint{ep("tcp6", "[::1]:80", 0), ep("tcp4", "127.0.0.1:81", 0)}},
+		{"tcp6://[::1]:80@2", []tunnel.Endpoint{ep("tcp6", "[::1]:80", 2)}},
+		{"unix:/var/run/docker.sock", []tunnel.Endpoint{ep("unix", "/var/run/docker.sock", 0)}},
+		{"unix:///tmp/a.sock@4", []tunnel.Endpoint{ep("unix", "/tmp/a.sock", 4)}},
+		{"unix:/tmp/user@host.sock", []tunnel.Endpoint{ep("unix", "/tmp/user@host.sock", 0)}},
+		{"a:1@2,b:2", nil}, // 混合有权重和没有权重的
+		{"a:1,b:2@2", nil}, // 混合有权重和没有权重的
+		{"a:1@0", nil},     // 权重必须大于0
+		{"a:1@x", nil},     // 权重不是数字
+		{"udp://a:1", nil}, // 不支持的传输
+		{"a", nil},         // 没有端口
+		{"unix:", nil},     // 空路径
+		{" , ", nil},       // 没有server
+	} {
+		eps, err := tunnel.ParseEndpoints(c.in)
+		if c.want == nil {
+			if err == nil {
+				t.Errorf("%q: accepted %v", c.in, eps)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(eps, c.want) {
+			t.Errorf("%q: %v %v, want %v", c.in, eps, err, c.want)
+		}
+	}
+}
+
+// / String可以再解析成同样的Endpoint, 用于日志和状态.
+func TestEndpointString(t *testing.T) {
+	for s, want := range map[string]string{
+		"a:1":                "a:1",
+		"tcp://a:1@2":        "a:1@2",
+		"tcp6://[::1]:80@3":  "tcp6://[::1]:80@3",
+		"unix:///tmp/a.sock": "unix:/tmp/a.sock",
+	} {
+		eps, err := tunnel.ParseEndpoints(s)
+		if err != nil || eps[0].String() != want {
+			t.Errorf("%q: %v %v, want %q", s, eps, err, want)
+			continue
+		}
+		if again, err := tunnel.ParseEndpoints(want); err != nil || again[0] != eps[0] {
+			t.Errorf("%q: reparsed %v %v", want, again, err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package ztests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+/// 发送完关闭写方向, 再读取全部echo. 对端收到CD_LINK_CLOSE_ReadErr时wchannel中还有数据.
+func halfCloseEcho(t *testing.T, caddr string, n int) {
+	c, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	data := make([]byte, n)
+	rand.Read(data)
+	go func() {
+		c.Write(data)
+		c.(*net.TCPConn).CloseWrite()
+	}()
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("echo %d of %d bytes: %v", len(got), n, err)
+	}
+}
+
+/// 不捆绑的link半关闭之后, 已经收到的数据仍然写入本地连接.
+func TestHalfClose(t *testing.T) {
+	saddr := freeAddr(t)
+	startServer(t, saddr)
+	caddr := startClient(t, saddr, nil)
+	for i := 0; i < 3; i++ {
+		halfCloseEcho(t, caddr, 4<<20)
+	}
+}
@@ -0,0 +1,101 @@
+package ztests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func TestRotateFile(t *testing.T) {
+	dir := t.TempDir()
+	rf, err := tunnel.NewRotateFile(dir, "gtwarn", 100, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	line := make([]byte, 60)
+	for i := 0; i < 5; i++ {
+		if _, err := rf.Write(line); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(5 * time.Millisecond) // 备份文件名精确到毫秒.
+	}
+	time.Sleep(50 * time.Millisecond) // wait cleanup
+
+	files, _ := filepath.Glob(filepath.Join(dir, "gtwarn*.log"))
+	if len(files) != 3 { // current + 2 backups
+		t.Fatalf("expect 3 files, got %v", files)
+	}
+
+	// logrotate moved the file away.
+	moved := rf.Path() + ".1"
+	if err := os.Rename(rf.Path(), moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := rf.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	rf.Write([]byte("after reopen\n"))
+	if info, err := os.Stat(rf.Path()); err != nil || info.Size() == 0 {
+		t.Fatalf("reopen failed: %v", err)
+	}
+}
+
+/// 新文件打开失败时Reopen保留原来的文件, 日志继续写入.
+func TestRotateFileReopenFailed(t *testing.T) {
+	dir := t.TempDir()
+	rf, err := tunnel.NewRotateFile(dir, "gtwarn", 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	moved := rf.Path() + ".1"
+	if err := os.Rename(rf.Path(), moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(rf.Path(), 0755); err != nil { // 目录不能作为日志文件打开
+		t.Fatal(err)
+	}
+	if err := rf.Reopen(); err == nil {
+		t.Fatal("reopen over a directory succeeded")
+	}
+	if _, err := rf.Write([]byte("still logging\n")); err != nil {
+		t.Fatalf("write after failed reopen: %v", err)
+	}
+	if info, err := os.Stat(moved); err != nil || info.Size() == 0 {
+		t.Fatalf("old file not written: %v", err)
+	}
+}
+
+/// 启动时也清理旧文件, 只清理本文件切分出的文件.
+func TestRotateFileCleanupAtStart(t *testing.T) {
+	dir := t.TempDir()
+	old := time.Now().Add(-time.Hour)
+	for i, name := range []string{"gtwarn2020-01-01.log", "gtwarn2020-01-02.120000.000.log", "gtwarn2020-01-03.log",
+		"gtwarn-notes.log", "gtwarnx.log", "gtwarn2020-01-01.log.1"} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mod := old.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(p, mod, mod)
+	}
+
+	rf, err := tunnel.NewRotateFile(dir, "gtwarn", 0, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	for name, keep := range map[string]bool{"gtwarn2020-01-01.log": false, "gtwarn2020-01-02.120000.000.log": false,
+		"gtwarn2020-01-03.log": true, "gtwarn-notes.log": true, "gtwarnx.log": true, "gtwarn2020-01-01.log.1": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != keep {
+			t.Errorf("%s: kept %v, want %v", name, err == nil, keep)
+		}
+	}
+}
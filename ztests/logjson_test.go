@@ -0,0 +1,51 @@
+package ztests
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func TestLogJSON(t *testing.T) {
+	tunnel.LogFormat = tunnel.LogFormatJSON
+	defer func() { tunnel.LogFormat = tunnel.LogFormatText }()
+
+	var buf bytes.Buffer
+	tunnel.InitLogger(&buf, 12)
+	tunnel.WarnEvent("link_close", tunnel.LogFields{
+		tunnel.FieldRole: "server",
+		tunnel.FieldTun:  100,
+		tunnel.FieldLink: 7,
+	})
+	tunnel.Warn("plain %d", 1)
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expect 2 lines, got %q", buf.String())
+	}
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(lines[0], &m); err != nil {
+		t.Fatal(err)
+	}
+	if m[tunnel.FieldEvent] != "link_close" || m[tunnel.FieldLink] != float64(7) || m["level"] != "WARNING" {
+		t.Fatalf("bad record: %v", m)
+	}
+
+	m = nil
+	if err := json.Unmarshal(lines[1], &m); err != nil {
+		t.Fatal(err)
+	}
+	if m["msg"] != "plain 1" {
+		t.Fatalf("bad record: %v", m)
+	}
+}
+
+func TestLogFieldsText(t *testing.T) {
+	f := tunnel.LogFields{tunnel.FieldEvent: "link_start", tunnel.FieldTun: 1, tunnel.FieldLink: 2}
+	if s := f.String(); s != "link_start link=2 tun=1" {
+		t.Fatalf("bad text: %s", s)
+	}
+}
@@ -0,0 +1,180 @@
+package ztests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+/// 端到端测试的公共部分: 本机的echo backend, server和client, 以及可以切断的中继.
+
+func init() {
+	tunnel.ExitOnError = false
+	tunnel.InitLogger(nil, 1)
+	tunnel.CipherName = "AES-128-CTR"
+}
+
+func listenLoopback(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+/// 空闲的本机地址
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+/// 原样返回收到的数据
+func echoServer(t *testing.T) string {
+	l := listenLoopback(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+/// 转发到target的中继, cut切断当前所有的连接, 模拟网络中断.
+type relay struct {
+	addr  string
+	mux   sync.Mutex
+	conns []net.Conn
+}
+
+func newRelay(t *testing.T, target string) *relay {
+	l := listenLoopback(t)
+	r := &relay{addr: l.Addr().String()}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			b, err := net.Dial("tcp", target)
+			if err != nil {
+				c.Close()
+				continue
+			}
+			for _, x := range []net.Conn{c, b} { // 小的socket缓冲, 像真实的网络一样很快写满
+				x.(*net.TCPConn).SetReadBuffer(32 << 10)
+				x.(*net.TCPConn).SetWriteBuffer(32 << 10)
+			}
+			r.mux.Lock()
+			r.conns = append(r.conns, c, b)
+			r.mux.Unlock()
+			go func() { io.Copy(b, c); b.Close() }()
+			go func() { io.Copy(c, b); c.Close() }()
+		}
+	}()
+	return r
+}
+
+func (r *relay) cut() {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	for _, c := range r.conns {
+		c.Close()
+	}
+	r.conns = nil
+}
+
+/// 启动server, backend是echo. 测试结束时停止.
+func startServer(t *testing.T, addr string) *tunnel.Server {
+	srv, err := tunnel.NewServer(addr, echoServer(t), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runServer(t, srv)
+	return srv
+}
+
+/// 运行srv, 测试结束时停止. 在恢复全局设置的Cleanup之前停止, 见setQuotas.
+func runServer(t *testing.T, srv *tunnel.Server) {
+	go srv.Start()
+	t.Cleanup(srv.Stop)
+}
+
+/// 启动连接serverAddr的client, 返回client的监听地址.
+func startClient(t *testing.T, serverAddr string, setup func(*tunnel.Client)) string {
+	return startClientSecret(t, serverAddr, "secret", setup)
+}
+
+func startClientSecret(t *testing.T, serverAddr, secret string, setup func(*tunnel.Client)) string {
+	caddr := freeAddr(t)
+	cli, err := tunnel.NewClient(caddr, serverAddr, secret, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if setup != nil {
+		setup(cli)
+	}
+	go cli.Start()
+	t.Cleanup(cli.Stop)
+	for i := 0; i < 50; i++ { // 等client开始监听
+		if c, err := net.Dial("tcp", caddr); err == nil {
+			c.Close()
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return caddr
+}
+
+/// 通过client发送n字节随机数据, 检查echo回来的数据. during在发送期间调用.
+func echoThrough(t *testing.T, caddr string, n int, during func()) {
+	c, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer c.Close()
+	data := make([]byte, n)
+	rand.Read(data)
+	go func() {
+		for off := 0; off < n; off += 64 << 10 {
+			end := off + 64<<10
+			if end > n {
+				end = n
+			}
+			if _, err := c.Write(data[off:end]); err != nil {
+				return
+			}
+			if during != nil && off >= n/2 {
+				during()
+				during = nil
+			}
+		}
+	}()
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got := make([]byte, n)
+	if m, err := io.ReadFull(c, got); err != nil {
+		t.Errorf("read %d of %d: %v", m, n, err)
+		return
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("echo mismatch")
+	}
+}
@@ -0,0 +1,19 @@
+package ztests
+
+import (
+	"testing"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func TestMPool(t *testing.T) {
+	p := tunnel.NewMPool(8192, 512)
+
+	for _, c := range []struct{ sz, cap int }{{0, 512}, {100, 512}, {512, 512}, {513, 8192}, {8192, 8192}, {10000, 10000}} {
+		b := p.Get(c.sz)
+		if len(b) != c.sz || cap(b) != c.cap {
+			t.Fatalf("get %d: len %d cap %d, expect cap %d", c.sz, len(b), cap(b), c.cap)
+		}
+		p.Put(b)
+	}
+}
@@ -0,0 +1,93 @@
+package ztests
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+/// 设置排队参数, 测试结束时恢复. 要在启动client之前调用.
+func setPending(t *testing.T, max int, timeout time.Duration) {
+	oldMax, oldTimeout := tunnel.PendingMax, tunnel.PendingTimeout
+	tunnel.PendingMax, tunnel.PendingTimeout = max, timeout
+	t.Cleanup(func() { tunnel.PendingMax, tunnel.PendingTimeout = oldMax, oldTimeout })
+}
+
+/// 等待c被关闭, 返回等待的时间.
+func waitClosed(t *testing.T, c net.Conn, limit time.Duration) time.Duration {
+	start := time.Now()
+	c.SetReadDeadline(start.Add(limit))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("read: %v, want EOF", err)
+	}
+	return time.Since(start)
+}
+
+/// 一直没有tunnel时, 排队的连接超时之后关闭.
+func TestPendingTimeout(t *testing.T) {
+	setPending(t, 128, 300*time.Millisecond)
+	caddr := startClient(t, freeAddr(t), nil) // server没有启动
+
+	c, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if d := waitClosed(t, c, 5*time.Second); d < 200*time.Millisecond {
+		t.Fatalf("closed after %v, before the pending timeout", d)
+	}
+}
+
+/// 队列满时新连接立即关闭, 已经排队的连接继续等待.
+func TestPendingFull(t *testing.T) {
+	setPending(t, 2, 5*time.Second)
+	caddr := startClient(t, freeAddr(t), nil) // startClient的探测连接占用一个位置
+
+	queued, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer queued.Close()
+	time.Sleep(50 * time.Millisecond) // 按顺序accept
+	dropped, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dropped.Close()
+
+	if d := waitClosed(t, dropped, time.Second); d > 500*time.Millisecond {
+		t.Fatalf("dropped after %v", d)
+	}
+	queued.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := queued.Read(make([]byte, 1)); err == io.EOF {
+		t.Fatal("queued connection closed")
+	}
+}
+
+/// server启动之后, 排队的连接交给第一个完成握手的hub, 之前写入的数据不丢失.
+func TestPendingDrain(t *testing.T) {
+	setPending(t, 128, 10*time.Second)
+	rmin, rmax := tunnel.RedialMin, tunnel.RedialMax
+	tunnel.RedialMin, tunnel.RedialMax = 50*time.Millisecond, 200*time.Millisecond
+	t.Cleanup(func() { tunnel.RedialMin, tunnel.RedialMax = rmin, rmax })
+
+	saddr := freeAddr(t)
+	caddr := startClient(t, saddr, nil)
+	c, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+
+	time.Sleep(300 * time.Millisecond)
+	startServer(t, saddr)
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(c, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo %q: %v", got, err)
+	}
+}
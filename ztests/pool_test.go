@@ -0,0 +1,40 @@
+package ztests
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+/// 按需模式下, 最后一个tunnel关闭期间到来的连接在排队, tunnel关闭之后要重新连接.
+func TestPoolDemandWhileDraining(t *testing.T) {
+	check, idle := tunnel.PoolCheckInterval, tunnel.PoolIdleTime
+	tunnel.PoolCheckInterval, tunnel.PoolIdleTime = 50*time.Millisecond, 100*time.Millisecond
+	t.Cleanup(func() { tunnel.PoolCheckInterval, tunnel.PoolIdleTime = check, idle })
+
+	saddr := freeAddr(t)
+	startServer(t, saddr)
+	var cli *tunnel.Client
+	caddr := startClient(t, saddr, func(c *tunnel.Client) {
+		c.MinTunnels, c.MaxTunnels = 0, 1
+		cli = c
+	})
+	echoThrough(t, caddr, 1<<10, nil)
+
+	// 空闲之后tunnel不再接受link, 等已有的link结束(至少1秒)才关闭
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		var b bytes.Buffer
+		cli.Status(&b)
+		if strings.Contains(b.String(), "tunnels 0/") {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pool did not shrink: %s", b.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	echoThrough(t, caddr, 1<<10, nil)
+}
@@ -0,0 +1,128 @@
+package ztests
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := tunnel.ParseCIDRs("10.0.0.0/8, 192.168.1.5,2001:db8::/32")
+	if err != nil || len(nets) != 3 {
+		t.Fatalf("parse: %v %v", nets, err)
+	}
+	for ip, want := range map[string]int{"10.1.2.3": 0, "192.168.1.5": 1, "2001:db8::1": 2} {
+		if !nets[want].Contains(net.ParseIP(ip)) {
+			t.Fatalf("%s not in %s", ip, nets[want])
+		}
+	}
+	if nets[1].Contains(net.ParseIP("192.168.1.6")) {
+		t.Fatal("single ip matched its neighbour")
+	}
+	if _, err := tunnel.ParseCIDRs("10.0.0.0/33"); err == nil {
+		t.Fatal("bad cidr accepted")
+	}
+	if nets, err := tunnel.ParseCIDRs(""); err != nil || len(nets) != 0 {
+		t.Fatalf("empty: %v %v", nets, err)
+	}
+}
+
+func setAcceptProxy(t *testing.T, trusted string) {
+	nets, err := tunnel.ParseCIDRs(trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel.AcceptProxy, tunnel.TrustedProxies = true, nets
+	t.Cleanup(func() { tunnel.AcceptProxy, tunnel.TrustedProxies = false, nil })
+}
+
+/// 没有信任的来源时任何连接都可以伪造地址, server拒绝启动.
+func TestAcceptProxyNeedsTrusted(t *testing.T) {
+	setAcceptProxy(t, "")
+	srv, err := tunnel.NewServer(freeAddr(t), echoServer(t), "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.Start(); err != tunnel.ErrNoTrustedProxies {
+		t.Fatalf("start: %v, want ErrNoTrustedProxies", err)
+	}
+}
+
+/// 不在信任列表中的来源不读取头, 按普通连接处理.
+func TestAcceptProxyUntrusted(t *testing.T) {
+	setAcceptProxy(t, "192.0.2.0/24")
+	saddr := freeAddr(t)
+	startServer(t, saddr)
+	echoThrough(t, startClient(t, saddr, nil), 1<<20, nil)
+}
+
+/// 记录收到的全部数据的backend. 健康检查的连接没有payload, 不记录.
+func captureBackend(t *testing.T, payload []byte) (string, <-chan []byte) {
+	l := listenLoopback(t)
+	ch := make(chan []byte, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b, _ := io.ReadAll(c)
+				if bytes.HasSuffix(b, payload) {
+					ch <- b
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), ch
+}
+
+/// server连接backend之后, 在client的数据之前写入PROXY头, 地址是client收到的本地连接的两端.
+func TestProxyHeaderToBackend(t *testing.T) {
+	payload := []byte("hello")
+	for _, version := range []string{tunnel.ProxyV1, tunnel.ProxyV2} {
+		backend, got := captureBackend(t, payload)
+		saddr := freeAddr(t)
+		srv, err := tunnel.NewServer(saddr, backend+"?proxy="+version, "secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		runServer(t, srv)
+		caddr := startClient(t, saddr, nil)
+
+		c, err := net.Dial("tcp", caddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		src, dst := c.LocalAddr().(*net.TCPAddr), c.RemoteAddr().(*net.TCPAddr)
+		c.Write(payload)
+		c.Close()
+
+		var want bytes.Buffer
+		if version == tunnel.ProxyV1 {
+			fmt.Fprintf(&want, "PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n", src.Port, dst.Port)
+		} else {
+			want.WriteString("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+			want.Write(src.IP.To4())
+			want.Write(dst.IP.To4())
+			binary.Write(&want, binary.BigEndian, [2]uint16{uint16(src.Port), uint16(dst.Port)})
+		}
+		want.Write(payload)
+
+		select {
+		case b := <-got:
+			if !bytes.Equal(b, want.Bytes()) {
+				t.Fatalf("%s: backend got %q, want %q", version, b, want.Bytes())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: backend got nothing", version)
+		}
+	}
+}
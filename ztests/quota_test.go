@@ -0,0 +1,102 @@
+package ztests
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+/// 本地连接没有得到echo: tunnel被拒绝, 连接排队超时之后关闭.
+func expectNoTunnel(t *testing.T, caddr string) {
+	c, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.Write([]byte("ping"))
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := io.ReadFull(c, make([]byte, 4)); err == nil {
+		t.Fatalf("got echo %d bytes, want rejected", n)
+	}
+}
+
+/// 设置准入限制, 测试结束时恢复. 要在启动server和client之前调用, 它们先停止, 之后才恢复.
+func setQuotas(t *testing.T, q tunnel.Quotas) {
+	tunnel.SetQuotas(q)
+	pending := tunnel.PendingTimeout
+	tunnel.PendingTimeout = time.Second
+	t.Cleanup(func() {
+		tunnel.SetQuotas(tunnel.Quotas{})
+		tunnel.PendingTimeout = pending
+	})
+}
+
+/// 会话恢复之后, 新连接继续占用IP名额.
+func TestQuotaIPAfterResume(t *testing.T) {
+	setQuotas(t, tunnel.Quotas{TunnelsPerIP: 1})
+	saddr := freeAddr(t)
+	r := newRelay(t, saddr)
+	startServer(t, saddr)
+	caddr := startClient(t, r.addr, nil)
+	echoThrough(t, caddr, 1<<20, nil)
+	for i := 0; i < 3; i++ {
+		echoThrough(t, caddr, 1<<20, r.cut)
+	}
+	expectNoTunnel(t, startClient(t, saddr, nil))
+}
+
+/// 每个用户的tunnel数按认证的secret计算, 同一个用户的多个secret共用名额.
+func TestQuotaPerUser(t *testing.T) {
+	setQuotas(t, tunnel.Quotas{TunnelsPerUser: 1})
+	saddr := freeAddr(t)
+	srv, err := tunnel.NewServer(saddr, echoServer(t), "user alice a-new")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.ExtraSecrets = []string{"user alice a-old", "user bob b1"}
+	runServer(t, srv)
+
+	echoThrough(t, startClientSecret(t, saddr, "a-old", nil), 1<<20, nil)
+	expectNoTunnel(t, startClientSecret(t, saddr, "user alice a-new", nil))
+	echoThrough(t, startClientSecret(t, saddr, "b1", nil), 1<<20, nil)
+}
+
+/// 超出每个tunnel的link数时新的连接被重置, 而不是正常结束; 名额释放之后可以再建立link.
+func TestQuotaLinksPerHub(t *testing.T) {
+	setQuotas(t, tunnel.Quotas{LinksPerHub: 1})
+	saddr := freeAddr(t)
+	startServer(t, saddr)
+	caddr := startClient(t, saddr, nil)
+	time.Sleep(200 * time.Millisecond) // startClient探测监听的连接也是一个link, 等它在server端结束
+
+	first, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.Write([]byte("ping"))
+	if _, err := io.ReadFull(first, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := net.Dial("tcp", caddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err == nil || err == io.EOF || isTimeout(err) {
+		t.Fatalf("second link: %v, want connection reset", err)
+	}
+	c.Close()
+
+	first.Close()
+	time.Sleep(200 * time.Millisecond) // 等server端的link结束
+	echoThrough(t, caddr, 1<<20, nil)
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
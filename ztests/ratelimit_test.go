@@ -0,0 +1,46 @@
+package ztests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := tunnel.NewRateLimiter(1 << 20)
+
+	start := time.Now()
+	l.Wait(1 << 20) // burst
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("burst should not wait, waited %v", d)
+	}
+
+	start = time.Now()
+	l.Wait(200 << 10)
+	if d := time.Since(start); d < 150*time.Millisecond || d > time.Second {
+		t.Fatalf("expect about 200ms, waited %v", d)
+	}
+
+	l.SetRate(0)
+	start = time.Now()
+	l.Wait(100 << 20)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Fatalf("unlimited should not wait, waited %v", d)
+	}
+}
+
+func TestParseRate(t *testing.T) {
+	for s, expect := range map[string]int64{"0": 0, "100": 100, "512k": 512 << 10, "10M": 10 << 20, "1G": 1 << 30} {
+		if n, err := tunnel.ParseRate(s); err != nil || n != expect {
+			t.Fatalf("parse %s: %d %v", s, n, err)
+		}
+	}
+	if _, err := tunnel.ParseRate("-1"); err == nil {
+		t.Fatal("negative rate should fail")
+	}
+	if _, err := tunnel.ParseRate(" 10xm"); err == nil || !strings.Contains(err.Error(), `" 10xm"`) {
+		t.Fatalf("error should show the input: %v", err)
+	}
+}
@@ -0,0 +1,53 @@
+package ztests
+
+import (
+	"bytes"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+/// 每64K字节换一次密钥, 多个link同时echo, 两个方向都换了很多次密钥, 数据不能出错.
+func TestRekeyLoopback(t *testing.T) {
+	old := tunnel.RekeyBytes
+	tunnel.RekeyBytes = 64 << 10
+	t.Cleanup(func() { tunnel.RekeyBytes = old })
+
+	saddr := freeAddr(t)
+	srv := startServer(t, saddr)
+	caddr := startClient(t, saddr, nil)
+
+	const links, n = 4, 1 << 20
+	var wg sync.WaitGroup
+	for i := 0; i < links; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			echoThrough(t, caddr, n, nil)
+		}()
+	}
+	wg.Wait()
+
+	var b bytes.Buffer
+	for deadline := time.Now().Add(5 * time.Second); ; { // 等link结束, 不再有写入
+		b.Reset()
+		srv.Status(&b)
+		if strings.Contains(b.String(), "links(0)") || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	m := regexp.MustCompile(`rekeys (\d+)`).FindStringSubmatch(b.String())
+	if m == nil {
+		t.Fatalf("no rekey: %s", b.String())
+	}
+	// 每个方向大约links*n/RekeyBytes次, server计入两个方向
+	if got, _ := strconv.Atoi(m[1]); got < 3*links*n/int(tunnel.RekeyBytes)/2 {
+		t.Fatalf("rekeys %d, want both directions", got)
+	}
+}
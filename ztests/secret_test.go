@@ -0,0 +1,51 @@
+package ztests
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func TestParseSecrets(t *testing.T) {
+	l := tunnel.ParseSecrets("# rotation\r\nnew secret\r\n\n  \nold\n")
+	if len(l) != 2 || l[0] != "new secret" || l[1] != "old" {
+		t.Fatalf("parse: %q", l)
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("s1\ns2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := tunnel.LoadSecrets(path); err != nil || len(l) != 2 || l[0] != "s1" {
+		t.Fatalf("load: %q %v", l, err)
+	}
+	if runtime.GOOS != "windows" {
+		os.Chmod(path, 0640)
+		if _, err := tunnel.LoadSecrets(path); err == nil {
+			t.Fatal("group readable file accepted")
+		}
+	}
+	os.WriteFile(path, []byte("# nothing\n"), 0600)
+	if _, err := tunnel.LoadSecrets(path); err == nil {
+		t.Fatal("empty file accepted")
+	}
+}
+
+func TestSplitSecret(t *testing.T) {
+	for line, want := range map[string][2]string{
+		"user alice s1":        {"alice", "s1"},
+		"user bob  a b c ":     {"bob", "a b c"},
+		"plain secret":         {tunnel.DefaultUser, "plain secret"},
+		"user onlyname":        {tunnel.DefaultUser, "user onlyname"},
+		"username secret here": {tunnel.DefaultUser, "username secret here"},
+	} {
+		if user, secret := tunnel.SplitSecret(line); user != want[0] || secret != want[1] {
+			t.Errorf("%q: %q %q, want %q %q", line, user, secret, want[0], want[1])
+		}
+	}
+}
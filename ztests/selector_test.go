@@ -0,0 +1,22 @@
+package ztests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func TestNewSelector(t *testing.T) {
+	for _, name := range strings.Fields(tunnel.ListSelector()) {
+		if s, err := tunnel.NewSelector(name); err != nil || s == nil {
+			t.Fatalf("selector %s: %v", name, err)
+		}
+	}
+	if _, err := tunnel.NewSelector("RoundRobin"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tunnel.NewSelector("random"); err != tunnel.ErrSelectorNotSupported {
+		t.Fatalf("unknown selector: %v", err)
+	}
+}
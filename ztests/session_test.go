@@ -0,0 +1,56 @@
+package ztests
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+/// 传输中切断tunnel, 会话恢复之后两个方向的数据都不丢失也不重复.
+/// 几个link同时收发, 两端都有大量未确认的数据, 恢复时同时重发.
+func TestSessionResume(t *testing.T) {
+	saddr := freeAddr(t)
+	r := newRelay(t, saddr)
+	startServer(t, saddr)
+	caddr := startClient(t, r.addr, nil)
+	var cut sync.Once
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			echoThrough(t, caddr, 8<<20, func() { cut.Do(r.cut) })
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 2; i++ { // 再断开两次
+		echoThrough(t, caddr, 2<<20, r.cut)
+	}
+}
+
+/// 流量很小, 不够按packet数确认时, 延迟确认也会释放两端未确认的数据.
+func TestSessionDelayedAck(t *testing.T) {
+	saddr := freeAddr(t)
+	srv := startServer(t, saddr)
+	var cli *tunnel.Client
+	caddr := startClient(t, saddr, func(c *tunnel.Client) { cli = c })
+	echoThrough(t, caddr, 100, nil)
+
+	var b bytes.Buffer
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		b.Reset()
+		cli.Status(&b)
+		srv.Status(&b)
+		if strings.Count(b.String(), "pending 0B") == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("pending not acked: %s", b.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
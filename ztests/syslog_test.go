@@ -0,0 +1,38 @@
+// +build !windows
+
+package ztests
+
+import (
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+func TestSyslog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := tunnel.InitSyslogLogger("unixgram", path, 1); err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.InitLogger(nil, 1)
+	tunnel.Warn("hello %s", "syslog")
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.Contains(msg, "hello syslog") || !strings.HasPrefix(msg, "<28>") {
+		t.Fatalf("bad syslog message: %s", msg)
+	}
+}
@@ -0,0 +1,74 @@
+package ztests
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dikinova/dktunnel/tunnel"
+)
+
+/// client监听unix socket, server的backend也是unix socket. 半关闭之后仍然收到全部echo.
+func TestUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+	bpath, cpath := filepath.Join(dir, "backend.sock"), filepath.Join(dir, "client.sock")
+
+	l, err := net.Listen("unix", bpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+
+	saddr := freeAddr(t)
+	srv, err := tunnel.NewServer(saddr, "unix:"+bpath, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runServer(t, srv)
+	cli, err := tunnel.NewClient("unix://"+cpath, saddr, "secret", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go cli.Start()
+	t.Cleanup(cli.Stop)
+
+	var c net.Conn
+	for i := 0; i < 50; i++ { // 等client开始监听
+		if c, err = net.Dial("unix", cpath); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go func() {
+		c.Write(data)
+		c.(*net.UnixConn).CloseWrite()
+	}()
+	c.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(c)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("echo %d of %d bytes: %v", len(got), len(data), err)
+	}
+}